@@ -1,266 +1,4137 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/extrame/xls"
 	"github.com/xuri/excelize/v2"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"gonum.org/v1/gonum/mat"
 	"gonum.org/v1/gonum/stat"
+	"gonum.org/v1/gonum/stat/distuv"
 )
 
-// Load CSV file
-func loadCSV(filename string) [][]string {
-	file, err := os.Open(filename)
+// Version of the tool, overridden at build time with
+// -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+// Describe the build: the version plus, when the binary was built from a
+// VCS checkout, the revision, its time and whether the tree was modified
+func buildInfo() string {
+	desc := filepath.Base(os.Args[0]) + " " + version
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return desc
+	}
+	settings := map[string]string{}
+	for _, setting := range info.Settings {
+		settings[setting.Key] = setting.Value
+	}
+	if rev := settings["vcs.revision"]; rev != "" {
+		desc += " (" + rev
+		if t := settings["vcs.time"]; t != "" {
+			desc += ", " + t
+		}
+		if settings["vcs.modified"] == "true" {
+			desc += ", modified"
+		}
+		desc += ")"
+	}
+	return desc + " " + info.GoVersion
+}
+
+// Logger receives diagnostic output: sheet selection, join progress,
+// warnings and fatal errors. Swap it to capture or silence those messages.
+var Logger = log.New(os.Stderr, "", 0)
+
+// CSVOptions controls how loadCSVWithOptions parses a file
+type CSVOptions struct {
+	Delimiter rune              // Field separator; zero means ','
+	Encoding  encoding.Encoding // Source text encoding; nil means UTF-8
+}
+
+// Look up a CSV text encoding by name. "" and "utf-8" return nil (no
+// transcoding); Latin-1 and Windows-1252 are decoded to UTF-8.
+func encodingFor(name string) (encoding.Encoding, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "utf-8", "utf8":
+		return nil, nil
+	case "latin1", "latin-1", "iso-8859-1":
+		return charmap.ISO8859_1, nil
+	case "windows-1252", "cp1252":
+		return charmap.Windows1252, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q (want \"utf-8\", \"latin1\" or \"windows-1252\")", name)
+}
+
+// Load CSV file with default options
+func loadCSV(filename string) ([][]string, error) {
+	return loadCSVWithOptions(filename, CSVOptions{})
+}
+
+// UTF-8 byte order mark, as written at the start of files by Excel
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// Load CSV file. A filename of "-" reads from standard input. Gzip-compressed
+// input is detected by a .gz suffix or the gzip magic header and
+// decompressed transparently, and a leading UTF-8 BOM is stripped.
+func loadCSVWithOptions(filename string, opts CSVOptions) ([][]string, error) {
+	var data [][]string
+	err := streamCSVWithOptions(filename, opts, func(row []string) error {
+		data = append(data, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Read a CSV file row by row, calling fn for each row without holding the
+// whole file in memory. Reading stops at the first error returned by fn.
+func streamCSV(filename string, fn func(row []string) error) error {
+	return streamCSVWithOptions(filename, CSVOptions{}, fn)
+}
+
+// Like streamCSV, with the same input handling as loadCSVWithOptions
+func streamCSVWithOptions(filename string, opts CSVOptions, fn func(row []string) error) error {
+	file := os.Stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return fmt.Errorf("error opening CSV file: %w", err)
+		}
+		defer f.Close()
+		file = f
+	}
+
+	buffered := bufio.NewReader(file)
+	var input io.Reader = buffered
+	if magic, _ := buffered.Peek(2); isGzip(magic) || strings.HasSuffix(strings.ToLower(filename), ".gz") {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return fmt.Errorf("error opening gzip CSV file: %w", err)
+		}
+		defer gz.Close()
+		input = gz
+	}
+
+	// Transcode legacy encodings to UTF-8 before parsing
+	if opts.Encoding != nil {
+		input = transform.NewReader(input, opts.Encoding.NewDecoder())
+	}
+
+	// Strip a leading UTF-8 byte order mark so it doesn't end up in the first header cell
+	unmarked := bufio.NewReader(input)
+	if bom, _ := unmarked.Peek(len(utf8BOM)); bytes.Equal(bom, utf8BOM) {
+		unmarked.Discard(len(utf8BOM))
+	}
+
+	// Rows may have any number of fields. Rows that can't be parsed at all
+	// (e.g. a stray quote) are skipped and their lines logged instead of
+	// aborting the load, unless an unclosed quote swallowed the rest of the file.
+	reader := csv.NewReader(unmarked)
+	reader.FieldsPerRecord = -1
+	if opts.Delimiter != 0 {
+		reader.Comma = opts.Delimiter
+	}
+	var skipped []string
+	logSkipped := func() {
+		if len(skipped) > 0 {
+			Logger.Printf("Skipped %d malformed rows in %s (lines %s)", len(skipped), filename, strings.Join(skipped, ", "))
+		}
+	}
+	row, err := reader.Read()
+	for {
+		if err == io.EOF {
+			logSkipped()
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			lines := strconv.Itoa(parseErr.StartLine)
+			if parseErr.Line > parseErr.StartLine {
+				lines += "-" + strconv.Itoa(parseErr.Line)
+			}
+			skipped = append(skipped, lines)
+			row, err = reader.Read()
+			if err == io.EOF && errors.Is(parseErr.Err, csv.ErrQuote) {
+				logSkipped()
+				return fmt.Errorf("error reading CSV file: quoted field in the row starting on line %d runs to the end of the file: %w", parseErr.StartLine, parseErr)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading CSV file: %w", err)
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+		row, err = reader.Read()
+	}
+}
+
+// Load a data file, choosing the loader from the extension: .csv and .txt
+// are comma-separated, .tsv is tab-separated and .xlsx is read from its
+// first sheet, as is the first .xlsx inside a .zip. A trailing .gz is
+// ignored when detecting the format, and "-" reads CSV from standard input.
+func loadData(filename string) ([][]string, error) {
+	return loadDataWithOptions(filename, CSVOptions{})
+}
+
+// Like loadData, but with CSV options for delimited formats. A zero
+// Delimiter picks the default for the extension.
+func loadDataWithOptions(filename string, opts CSVOptions) ([][]string, error) {
+	if filename == "-" {
+		return loadCSVWithOptions(filename, opts)
+	}
+	ext := dataExtension(filename)
+	switch ext {
+	case ".csv", ".txt":
+		return loadCSVWithOptions(filename, opts)
+	case ".tsv":
+		if opts.Delimiter == 0 {
+			opts.Delimiter = '\t'
+		}
+		return loadCSVWithOptions(filename, opts)
+	case ".xlsx", ".zip":
+		return loadExcel(filename)
+	case ".xls":
+		return loadExcelXLS(filename)
+	}
+	return nil, fmt.Errorf("unsupported file format %q for %s (want .csv, .tsv, .txt, .xls, .xlsx or .zip)", ext, filename)
+}
+
+// Lowercase extension that picks a file's loader, ignoring a trailing .gz
+func dataExtension(filename string) string {
+	return filepath.Ext(strings.TrimSuffix(strings.ToLower(filename), ".gz"))
+}
+
+// Like loadDataWithOptions, but a file without a known data extension, such
+// as flares.dat or the /dev/fd/63 of a process substitution, is read as
+// delimited text instead of being rejected
+func loadDelimitedWithOptions(filename string, opts CSVOptions) ([][]string, error) {
+	switch dataExtension(filename) {
+	case ".tsv", ".xlsx", ".zip", ".xls":
+		return loadDataWithOptions(filename, opts)
+	}
+	return loadCSVWithOptions(filename, opts)
+}
+
+// Trim leading and trailing whitespace from every cell, in place
+func trimCells(data [][]string) {
+	for _, row := range data {
+		for j, cell := range row {
+			row[j] = strings.TrimSpace(cell)
+		}
+	}
+}
+
+// Parse a delimiter flag value: a single character, or "\t"/"tab" for tabs.
+// An empty value returns 0, meaning the default for the file format.
+func parseDelimiter(s string) (rune, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if s == `\t` || strings.EqualFold(s, "tab") {
+		return '\t', nil
+	}
+	if utf8.RuneCountInString(s) != 1 {
+		return 0, fmt.Errorf("delimiter must be a single character, got %q", s)
+	}
+	r, _ := utf8.DecodeRuneInString(s)
+	return r, nil
+}
+
+// Ensure a dataset starts with a header row. When hasHeader is false, row 0
+// is real data, so a generated header (column0, column1, ...) is prepended
+// instead of letting downstream code drop the first record.
+func withHeader(data [][]string, hasHeader bool) [][]string {
+	if hasHeader {
+		return data
+	}
+	width := 0
+	for _, row := range data {
+		if len(row) > width {
+			width = len(row)
+		}
+	}
+	header := make([]string, width)
+	for i := range header {
+		header[i] = fmt.Sprintf("column%d", i)
+	}
+	return append([][]string{header}, data...)
+}
+
+// Report whether data starts with the gzip magic header
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// Load the first sheet of an Excel file
+func loadExcel(filename string) ([][]string, error) {
+	f, err := openExcel(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening Excel file: %w", err)
+	}
+	defer f.Close()
+
+	// Print available sheet names
+	sheets := f.GetSheetList()
+	Logger.Println("Available Sheets in Excel:", sheets)
+
+	// Use the first sheet automatically
+	if len(sheets) == 0 {
+		return nil, fmt.Errorf("no sheets found in the Excel file")
+	}
+	return readExcelSheet(f, sheets[0])
+}
+
+// Open an Excel file, or the first .xlsx member of a .zip archive
+func openExcel(filename string) (*excelize.File, error) {
+	if !strings.EqualFold(filepath.Ext(filename), ".zip") {
+		return excelize.OpenFile(filename)
+	}
+
+	archive, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening zip archive: %w", err)
+	}
+	defer archive.Close()
+	for _, member := range archive.File {
+		if member.FileInfo().IsDir() || !strings.EqualFold(filepath.Ext(member.Name), ".xlsx") {
+			continue
+		}
+		r, err := member.Open()
+		if err != nil {
+			return nil, fmt.Errorf("error opening %s in zip archive: %w", member.Name, err)
+		}
+		defer r.Close()
+		Logger.Println("Using Excel file from zip archive:", member.Name)
+		return excelize.OpenReader(r)
+	}
+	return nil, fmt.Errorf("no .xlsx file found in zip archive %s", filename)
+}
+
+// Load a named sheet from an Excel file
+func loadExcelSheet(filename, sheetName string) ([][]string, error) {
+	f, err := openExcel(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening Excel file: %w", err)
+	}
+	defer f.Close()
+
+	return readExcelSheet(f, sheetName)
+}
+
+// Load a sheet from an Excel file by its 1-based position among the tabs
+func loadExcelByIndex(filename string, idx int) ([][]string, error) {
+	f, err := openExcel(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening Excel file: %w", err)
+	}
+	defer f.Close()
+
+	sheets := f.GetSheetList()
+	if idx < 1 || idx > len(sheets) {
+		return nil, fmt.Errorf("sheet index %d out of range: the Excel file has %d sheets (%s)", idx, len(sheets), strings.Join(sheets, ", "))
+	}
+	return readExcelSheet(f, sheets[idx-1])
+}
+
+// Load every sheet of an Excel file as one dataset: the first sheet's
+// header followed by the data rows of all sheets in tab order. Each later
+// sheet's header row is dropped, and must have as many columns as the
+// first. Empty sheets are skipped.
+func loadExcelAllSheets(filename string) ([][]string, error) {
+	f, err := openExcel(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening Excel file: %w", err)
+	}
+	defer f.Close()
+
+	var combined [][]string
+	var first string
+	for _, sheet := range f.GetSheetList() {
+		rows, err := readExcelSheet(f, sheet)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			Logger.Printf("Skipping empty sheet %q\n", sheet)
+			continue
+		}
+		if combined == nil {
+			combined, first = rows, sheet
+			continue
+		}
+		if len(rows[0]) != len(combined[0]) {
+			return nil, fmt.Errorf("sheet %q has %d header columns but sheet %q has %d", sheet, len(rows[0]), first, len(combined[0]))
+		}
+		combined = append(combined, rows[1:]...)
+	}
+	if combined == nil {
+		return nil, fmt.Errorf("no rows found in any sheet of the Excel file")
+	}
+	return combined, nil
+}
+
+// Read all rows of a sheet, checking that the sheet exists first
+func readExcelSheet(f *excelize.File, sheetName string) ([][]string, error) {
+	sheets := f.GetSheetList()
+	found := false
+	for _, sheet := range sheets {
+		if sheet == sheetName {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("sheet %q not found in the Excel file (available: %s)", sheetName, strings.Join(sheets, ", "))
+	}
+	Logger.Println("Using Sheet:", sheetName)
+
+	// Read the sheet data as raw values rather than as displayed: a number
+	// formatted as a date (or rounded by its format) would otherwise come back
+	// as "02-05-00" (or "4") instead of 36.75. Date cells therefore read as
+	// their serial numbers.
+	rows, err := f.GetRows(sheetName, excelize.Options{RawCellValue: true})
+	if err != nil {
+		return nil, fmt.Errorf("error reading Excel sheet: %w", err)
+	}
+
+	// Formulas saved without a cached result read as empty; evaluate them
+	for i, row := range rows {
+		for j, val := range row {
+			if val != "" {
+				continue
+			}
+			cell, err := excelize.CoordinatesToCellName(j+1, i+1)
+			if err != nil {
+				return nil, fmt.Errorf("error reading Excel sheet: %w", err)
+			}
+			if formula, _ := f.GetCellFormula(sheetName, cell); formula != "" {
+				// Formulas excelize can't evaluate stay empty, as before
+				if value, err := f.CalcCellValue(sheetName, cell, excelize.Options{RawCellValue: true}); err == nil {
+					row[j] = value
+				}
+			}
+		}
+	}
+	return rows, nil
+}
+
+// Load the first sheet of a legacy .xls workbook. Files that are really
+// .xlsx under an .xls name are passed on to loadExcel.
+func loadExcelXLS(filename string) ([][]string, error) {
+	wb, err := xls.Open(filename, "utf-8")
+	if err != nil {
+		rows, xlsxErr := loadExcel(filename)
+		if xlsxErr != nil {
+			return nil, fmt.Errorf("error opening %s as .xls (%v) or .xlsx: %w", filename, err, xlsxErr)
+		}
+		return rows, nil
+	}
+
+	if wb.NumSheets() == 0 {
+		return nil, fmt.Errorf("no sheets found in the Excel file")
+	}
+	sheet := wb.GetSheet(0)
+	if sheet == nil {
+		return nil, fmt.Errorf("error reading first sheet of %s", filename)
+	}
+	Logger.Println("Using Sheet:", sheet.Name)
+
+	// MaxRow is the index of the last row, not the row count
+	var rows [][]string
+	for i := 0; i <= int(sheet.MaxRow); i++ {
+		row := xlsRow(sheet, i)
+		if row == nil {
+			rows = append(rows, []string{})
+			continue
+		}
+		cells := make([]string, row.LastCol())
+		for c := range cells {
+			cells[c] = row.Col(c)
+		}
+		rows = append(rows, cells)
+	}
+	return rows, nil
+}
+
+// Fetch a row from an .xls sheet, or nil if the sheet has no such row
+// (WorkSheet.Row dereferences the missing row and panics).
+func xlsRow(sheet *xls.WorkSheet, i int) (row *xls.Row) {
+	defer func() {
+		if recover() != nil {
+			row = nil
+		}
+	}()
+	return sheet.Row(i)
+}
+
+// Find the position of a column in a header row by name (case-insensitive)
+func colIndex(header []string, name string) (int, error) {
+	for i, h := range header {
+		if strings.EqualFold(strings.TrimSpace(h), strings.TrimSpace(name)) {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("column %q not found in header %v", name, header)
+}
+
+// Resolve a column given either as a header name or as a numeric index
+func resolveColumn(header []string, spec string) (int, error) {
+	if idx, err := strconv.Atoi(strings.TrimSpace(spec)); err == nil {
+		if idx < 0 || idx >= len(header) {
+			return -1, fmt.Errorf("column index %d out of range (header has %d columns)", idx, len(header))
+		}
+		return idx, nil
+	}
+	return colIndex(header, spec)
+}
+
+// Strip accents from a string by decomposing it and dropping the combining
+// marks, so "Côte d'Ivoire" becomes "Cote d'Ivoire"
+func stripAccents(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Function to filter data by country (case- and accent-insensitive)
+func filterByCountry(data [][]string, countryCol int, country string) [][]string {
+	return filterByCountries(data, countryCol, []string{country})
+}
+
+// Function to filter data to rows matching any of several countries
+// (case- and accent-insensitive)
+func filterByCountries(data [][]string, countryCol int, countries []string) [][]string {
+	folded := make([]string, len(countries))
+	for i, country := range countries {
+		folded[i] = stripAccents(country)
+	}
+
+	var result [][]string
+	for _, row := range data {
+		if len(row) <= countryCol {
+			continue
+		}
+		value := stripAccents(row[countryCol])
+		for _, country := range folded {
+			if strings.EqualFold(value, country) {
+				result = append(result, row)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Keep rows whose coordinates lie inside a lat/lon box, edges included.
+// A box with minLon > maxLon wraps across the 180th meridian. Rows whose
+// coordinates don't parse, or that are too short for them, are dropped.
+func filterByBoundingBox(data [][]string, latCol, lonCol int, minLat, minLon, maxLat, maxLon float64) [][]string {
+	var result [][]string
+	for _, row := range data {
+		if !hasColumns(row, latCol, lonCol) {
+			continue
+		}
+		lat, lon, ok := parseLatLon(row, latCol, lonCol)
+		if !ok || lat < minLat || lat > maxLat {
+			continue
+		}
+		inLon := lon >= minLon && lon <= maxLon
+		if minLon > maxLon {
+			inLon = lon >= minLon || lon <= maxLon
+		}
+		if inLon {
+			result = append(result, row)
+		}
+	}
+	return result
+}
+
+// Parse a bounding box given as "minLat,minLon,maxLat,maxLon"
+func parseBoundingBox(s string) ([4]float64, error) {
+	var box [4]float64
+	fields := strings.Split(s, ",")
+	if len(fields) != 4 {
+		return box, fmt.Errorf("bounding box %q needs 4 comma-separated values (minLat,minLon,maxLat,maxLon)", s)
+	}
+	for i, f := range fields {
+		val, ok := parseFloatStrict(f)
+		if !ok {
+			return box, fmt.Errorf("bounding box value %q is not a number", strings.TrimSpace(f))
+		}
+		box[i] = val
+	}
+	if box[0] > box[2] {
+		return box, fmt.Errorf("bounding box minimum latitude %g is above the maximum %g", box[0], box[2])
+	}
+	return box, nil
+}
+
+// Count the rows holding each distinct value of a column. Values are taken
+// as-is, so variants such as "Algeria " are counted separately. Rows too
+// short for the column are ignored.
+func countByColumn(data [][]string, col int) map[string]int {
+	counts := make(map[string]int)
+	for _, row := range data {
+		if len(row) > col {
+			counts[row[col]]++
+		}
+	}
+	return counts
+}
+
+// Print value counts, most frequent first, quoting values so stray
+// whitespace is visible
+func printCounts(label string, counts map[string]int) {
+	values := make([]string, 0, len(counts))
+	for v := range counts {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if counts[values[i]] != counts[values[j]] {
+			return counts[values[i]] > counts[values[j]]
+		}
+		return values[i] < values[j]
+	})
+
+	fmt.Printf("\n%s: %d distinct values\n", label, len(values))
+	for _, v := range values {
+		fmt.Printf("%8d  %q\n", counts[v], v)
+	}
+}
+
+// Function to filter Algeria data
+func filterAlgeria(data [][]string, countryCol int) [][]string {
+	return filterByCountry(data, countryCol, "Algeria")
+}
+
+// Remove exact duplicate rows, keeping the header (row 0) and the first
+// occurrence of each row in order
+func dedupeRows(data [][]string) [][]string {
+	return dedupeRowsOn(data, nil)
+}
+
+// Like dedupeRows, but rows count as duplicates when they agree on the given
+// key columns. A nil keyCols compares whole rows.
+func dedupeRowsOn(data [][]string, keyCols []int) [][]string {
+	if len(data) == 0 {
+		return data
+	}
+	seen := make(map[string]bool)
+	result := [][]string{data[0]}
+	for _, row := range data[1:] {
+		key := rowKey(row, keyCols)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, row)
+	}
+	return result
+}
+
+// Build a map key from the given columns of a row (all columns when cols is
+// nil). Each cell is length-prefixed so different rows can't collide, and
+// cells missing from short rows are marked apart from empty ones.
+func rowKey(row []string, cols []int) string {
+	var b strings.Builder
+	add := func(i int) {
+		if i >= len(row) {
+			b.WriteString("-;")
+			return
+		}
+		b.WriteString(strconv.Itoa(len(row[i])))
+		b.WriteByte(':')
+		b.WriteString(row[i])
+	}
+	if cols == nil {
+		for i := range row {
+			add(i)
+		}
+	} else {
+		for _, i := range cols {
+			add(i)
+		}
+	}
+	return b.String()
+}
+
+// Header names recognized by guessLatLon
+var (
+	latitudeNames  = []string{"lat", "latitude"}
+	longitudeNames = []string{"lon", "lng", "long", "longitude"}
+)
+
+// Guess the latitude and longitude columns from header names such as "lat",
+// "Latitude (deg)", "lng" or "longitude". ok is false unless exactly one
+// column is found for each.
+func guessLatLon(header []string) (latIdx, lonIdx int, ok bool) {
+	latIdx, latOK := guessColumn(header, latitudeNames)
+	lonIdx, lonOK := guessColumn(header, longitudeNames)
+	if !latOK || !lonOK || latIdx == lonIdx {
+		return -1, -1, false
+	}
+	return latIdx, lonIdx, true
+}
+
+// Find the one column named exactly like one of names, or failing that the
+// one column with a word (split on non-letters) equal to one of names
+func guessColumn(header []string, names []string) (int, bool) {
+	isName := func(s string) bool {
+		for _, name := range names {
+			if s == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	var exact, partial []int
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if isName(h) {
+			exact = append(exact, i)
+			continue
+		}
+		words := strings.FieldsFunc(h, func(r rune) bool { return !unicode.IsLetter(r) })
+		for _, w := range words {
+			if isName(w) {
+				partial = append(partial, i)
+				break
+			}
+		}
+	}
+	if len(exact) > 0 {
+		return exact[0], len(exact) == 1
+	}
+	if len(partial) == 1 {
+		return partial[0], true
+	}
+	return -1, false
+}
+
+// Earth's radius in km, as used by haversine
+const earthRadiusKm = 6371
+
+// Haversine formula to calculate distance (in km)
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	return haversineCos(lat1, lon1, math.Cos(lat1*(math.Pi/180.0)), lat2, lon2, math.Cos(lat2*(math.Pi/180.0)))
+}
+
+// Haversine distance (in km) with the cosine of each latitude supplied by the
+// caller, so join loops can compute it once per point instead of per pair
+func haversineCos(lat1, lon1, cosLat1, lat2, lon2, cosLat2 float64) float64 {
+	return earthRadiusKm * haversineAngle(lat1, lon1, cosLat1, lat2, lon2, cosLat2)
+}
+
+// Central angle in radians between two points by the haversine formula
+func haversineAngle(lat1, lon1, cosLat1, lat2, lon2, cosLat2 float64) float64 {
+	// Identical points, common in overlapping datasets, skip the trigonometry
+	if lat1 == lat2 && lon1 == lon2 {
+		return 0
+	}
+	dLat := (lat2 - lat1) * (math.Pi / 180.0)
+	dLon := (lon2 - lon1) * (math.Pi / 180.0)
+
+	sinLat, sinLon := math.Sin(dLat/2), math.Sin(dLon/2)
+	a := sinLat*sinLat + cosLat1*cosLat2*sinLon*sinLon
+	return 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// DistanceUnit selects the unit haversineIn reports distances in. The zero
+// value is Kilometers, the unit used everywhere else.
+type DistanceUnit int
+
+const (
+	Kilometers DistanceUnit = iota
+	Miles
+	Meters
+	NauticalMiles
+)
+
+// Earth's radius expressed in the unit
+func (u DistanceUnit) earthRadius() float64 {
+	switch u {
+	case Miles:
+		return earthRadiusKm / 1.609344
+	case Meters:
+		return earthRadiusKm * 1000
+	case NauticalMiles:
+		return earthRadiusKm / 1.852
+	}
+	return earthRadiusKm
+}
+
+// Name of the unit, e.g. for labelling output
+func (u DistanceUnit) String() string {
+	switch u {
+	case Miles:
+		return "mi"
+	case Meters:
+		return "m"
+	case NauticalMiles:
+		return "nmi"
+	}
+	return "km"
+}
+
+// Haversine distance in the given unit
+func haversineIn(lat1, lon1, lat2, lon2 float64, unit DistanceUnit) float64 {
+	angle := haversineAngle(lat1, lon1, math.Cos(lat1*(math.Pi/180.0)), lat2, lon2, math.Cos(lat2*(math.Pi/180.0)))
+	return unit.earthRadius() * angle
+}
+
+// Vincenty's inverse formula on the WGS-84 ellipsoid (distance in km).
+// Nearly antipodal points, where the iteration does not converge, fall back
+// to the spherical haversine distance.
+func vincenty(lat1, lon1, lat2, lon2 float64) float64 {
+	const (
+		a = 6378137.0         // WGS-84 semi-major axis in meters
+		f = 1 / 298.257223563 // WGS-84 flattening
+		b = a * (1 - f)       // Semi-minor axis in meters
+	)
+	L := (lon2 - lon1) * (math.Pi / 180.0)
+	sinU1, cosU1 := math.Sincos(math.Atan((1 - f) * math.Tan(lat1*(math.Pi/180.0))))
+	sinU2, cosU2 := math.Sincos(math.Atan((1 - f) * math.Tan(lat2*(math.Pi/180.0))))
+
+	lambda := L
+	for iter := 0; iter < 200; iter++ {
+		sinLambda, cosLambda := math.Sincos(lambda)
+		sinSigma := math.Hypot(cosU2*sinLambda, cosU1*sinU2-sinU1*cosU2*cosLambda)
+		if sinSigma == 0 {
+			return 0 // Coincident points
+		}
+		cosSigma := sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma := math.Atan2(sinSigma, cosSigma)
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cosSqAlpha := 1 - sinAlpha*sinAlpha
+		cos2SigmaM := 0.0 // Zero on equatorial lines
+		if cosSqAlpha != 0 {
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cosSqAlpha
+		}
+		C := f / 16 * cosSqAlpha * (4 + f*(4-3*cosSqAlpha))
+		lambdaPrev := lambda
+		lambda = L + (1-C)*f*sinAlpha*(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+
+		if math.Abs(lambda-lambdaPrev) < 1e-12 {
+			uSq := cosSqAlpha * (a*a - b*b) / (b * b)
+			A := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+			B := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+			deltaSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+				B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+			return b * A * (sigma - deltaSigma) / 1000
+		}
+	}
+	return haversine(lat1, lon1, lat2, lon2)
+}
+
+// Look up a distance function by name. Haversine is returned as nil, which
+// joins treat as their default and evaluate with cached trigonometry.
+func distanceFuncFor(name string) (func(lat1, lon1, lat2, lon2 float64) float64, error) {
+	switch name {
+	case "haversine":
+		return nil, nil
+	case "vincenty":
+		return vincenty, nil
+	}
+	return nil, fmt.Errorf("unknown distance function %q (want \"haversine\" or \"vincenty\")", name)
+}
+
+// Convert string to float safely
+func parseFloat(s string) float64 {
+	val, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0.0
+	}
+	return val
+}
+
+// Convert string to float, reporting whether it parsed to a finite number
+func parseFloatStrict(s string) (float64, bool) {
+	val, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(val) || math.IsInf(val, 0) {
+		return 0.0, false
+	}
+	return val, true
+}
+
+// Parse a coordinate in decimal degrees ("-36.75") or degrees-minutes-seconds
+// ("36°45'N", "36 45 30 S") into signed decimal degrees
+func parseCoordinate(s string) (float64, error) {
+	t := strings.ToUpper(strings.TrimSpace(s))
+	if t == "" {
+		return 0, fmt.Errorf("empty coordinate")
+	}
+
+	// A hemisphere letter may lead or trail; S and W are negative
+	sign := 1.0
+	hemisphere := false
+	if r := t[len(t)-1]; strings.IndexByte("NSEW", r) >= 0 {
+		hemisphere = true
+		if r == 'S' || r == 'W' {
+			sign = -1
+		}
+		t = strings.TrimSpace(t[:len(t)-1])
+	} else if r := t[0]; strings.IndexByte("NSEW", r) >= 0 {
+		hemisphere = true
+		if r == 'S' || r == 'W' {
+			sign = -1
+		}
+		t = strings.TrimSpace(t[1:])
+	}
+	if strings.HasPrefix(t, "-") {
+		if hemisphere {
+			return 0, fmt.Errorf("invalid coordinate %q: both a sign and a hemisphere", s)
+		}
+		sign = -1
+		t = t[1:]
+	} else {
+		t = strings.TrimPrefix(t, "+")
+	}
+
+	parts := strings.FieldsFunc(t, func(r rune) bool {
+		switch r {
+		case '°', 'º', '\'', '′', '"', '″', ' ', '\t':
+			return true
+		}
+		return false
+	})
+	if len(parts) == 0 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid coordinate %q", s)
+	}
+	var fields [3]float64
+	for i, part := range parts {
+		val, ok := parseFloatStrict(part)
+		if !ok || val < 0 {
+			return 0, fmt.Errorf("invalid coordinate %q", s)
+		}
+		if i > 0 && val >= 60 {
+			return 0, fmt.Errorf("invalid coordinate %q: minutes and seconds must be below 60", s)
+		}
+		fields[i] = val
+	}
+	return sign * (fields[0] + fields[1]/60 + fields[2]/3600), nil
+}
+
+// Report whether a row is long enough to hold every given column
+func hasColumns(row []string, cols ...int) bool {
+	for _, c := range cols {
+		if c < 0 || c >= len(row) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse the coordinate pair of a row, reporting whether both parsed
+func parseLatLon(row []string, latCol, lonCol int) (float64, float64, bool) {
+	lat, latErr := parseCoordinate(row[latCol])
+	lon, lonErr := parseCoordinate(row[lonCol])
+	return lat, lon, latErr == nil && lonErr == nil
+}
+
+// Write rows to a CSV file
+func writeCSV(filename string, rows [][]string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating CSV file: %w", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	for _, row := range rows {
+		if err := writer.Write(row); err != nil {
+			return fmt.Errorf("error writing CSV file: %w", err)
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("error flushing CSV file: %w", err)
+	}
+	return nil
+}
+
+// Write rows to a new Excel workbook holding a single sheet. Every cell is
+// written as text, so numeric-looking values such as IDs or coordinates are
+// kept exactly as they are instead of being reformatted by Excel.
+func writeExcel(filename, sheetName string, rows [][]string) error {
+	f := excelize.NewFile()
+	defer f.Close()
+	if err := f.SetSheetName(f.GetSheetName(0), sheetName); err != nil {
+		return fmt.Errorf("error naming Excel sheet: %w", err)
+	}
+
+	stream, err := f.NewStreamWriter(sheetName)
+	if err != nil {
+		return fmt.Errorf("error creating Excel sheet: %w", err)
+	}
+	for i, row := range rows {
+		cells := make([]interface{}, len(row))
+		for j, val := range row {
+			cells[j] = excelize.Cell{Value: val}
+		}
+		cell, err := excelize.CoordinatesToCellName(1, i+1)
+		if err != nil {
+			return fmt.Errorf("error writing Excel file: %w", err)
+		}
+		if err := stream.SetRow(cell, cells); err != nil {
+			return fmt.Errorf("error writing Excel file: %w", err)
+		}
+	}
+	if err := stream.Flush(); err != nil {
+		return fmt.Errorf("error flushing Excel file: %w", err)
+	}
+
+	// Write through our own file rather than SaveAs, which insists on an Excel extension
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating Excel file: %w", err)
+	}
+	defer file.Close()
+	if _, err := f.WriteTo(file); err != nil {
+		return fmt.Errorf("error saving Excel file: %w", err)
+	}
+	return nil
+}
+
+// Write rows to the named sheet of an Excel file when asExcel is set,
+// otherwise as CSV
+func writeRows(filename, sheetName string, rows [][]string, asExcel bool) error {
+	if asExcel {
+		return writeExcel(filename, sheetName, rows)
+	}
+	return writeCSV(filename, rows)
+}
+
+// Save unmatched CSV rows, preceded by the original CSV header, as Excel
+// when asExcel is set and CSV otherwise
+func SaveDanglingRecords(filename string, header []string, data [][]string, asExcel bool) error {
+	return writeRows(filename, "Dangling", append([][]string{header}, data...), asExcel)
+}
+
+// Relative slack added to the grid search window so that distance functions
+// other than haversine (e.g. ellipsoidal ones, within ~0.5% of the sphere)
+// never miss a candidate
+const gridDistanceSlack = 0.01
+
+// spatialGrid buckets points into lat/lon cells sized to the join radius so
+// that a radius query only has to look at the neighbouring cells instead of
+// every point. Results are identical to a linear scan, ties included.
+type spatialGrid struct {
+	radiusKm float64
+	cellDeg  float64 // Cell size in degrees, equal to the search radius in degrees of latitude
+	nLon     int     // Number of longitude cells around the globe
+	lats     []float64
+	lons     []float64
+	cells    map[[2]int][]int
+	overflow []int // Points with latitudes outside [-90, 90], checked on every query
+
+	wrappedLons []float64 // Longitudes mapped onto [0, 360) for the bounding box
+
+	// Distance function; nil means haversine using the cached cos(lat) values
+	distance func(lat1, lon1, lat2, lon2 float64) float64
+	cosLats  []float64
+
+	// Orders points at exactly the same distance; nil, or two points it
+	// can't separate, fall back to the lower index
+	tieLess func(i, j int) bool
+}
+
+// Build a grid over the given coordinates for queries within radiusKm.
+// A nil distance uses haversine with each point's cos(lat) precomputed.
+func newSpatialGrid(lats, lons []float64, radiusKm float64, distance func(lat1, lon1, lat2, lon2 float64) float64) *spatialGrid {
+	g := &spatialGrid{
+		radiusKm: radiusKm,
+		distance: distance,
+		lats:     lats,
+		lons:     lons,
+		cells:    make(map[[2]int][]int),
+	}
+	g.wrappedLons = make([]float64, len(lons))
+	for i, lon := range lons {
+		g.wrappedLons[i] = wrapLon(lon)
+	}
+	if distance == nil {
+		g.cosLats = make([]float64, len(lats))
+		for i, lat := range lats {
+			g.cosLats[i] = math.Cos(lat * (math.Pi / 180.0))
+		}
+	}
+	if radiusKm <= 0 {
+		return g
+	}
+	g.cellDeg = radiusKm * (1 + gridDistanceSlack) / earthRadiusKm * (180.0 / math.Pi)
+	g.nLon = int(math.Ceil(360 / g.cellDeg))
+
+	for i := range lats {
+		lat, lon := lats[i], lons[i]
+		switch {
+		case math.IsNaN(lat) || math.IsNaN(lon) || math.IsInf(lat, 0) || math.IsInf(lon, 0):
+			// haversine is NaN for these, so they can never match
+		case lat < -90 || lat > 90:
+			g.overflow = append(g.overflow, i)
+		default:
+			key := [2]int{g.latCell(lat), g.lonCell(wrapLon(lon))}
+			g.cells[key] = append(g.cells[key], i)
+		}
+	}
+	return g
+}
+
+// Map a longitude onto [0, 360)
+func wrapLon(lon float64) float64 {
+	w := math.Mod(lon+180, 360)
+	if w < 0 {
+		w += 360
+	}
+	return w
+}
+
+func (g *spatialGrid) latCell(lat float64) int {
+	return int(math.Floor(lat / g.cellDeg))
+}
+
+func (g *spatialGrid) lonCell(wrapped float64) int {
+	return int(math.Floor(wrapped / g.cellDeg))
+}
+
+// Largest longitude difference (in degrees) a point within the search radius
+// of latitude lat can have, or allLon when every longitude is reachable.
+// From the haversine formula, hav(dLon) <= hav(radius) / cos^2(maxLat).
+func (g *spatialGrid) lonWindow(lat float64) (dLon float64, allLon bool) {
+	maxLat := math.Abs(lat) + g.cellDeg
+	if maxLat >= 90 {
+		return 0, true
+	}
+	s := math.Sin(g.cellDeg*(math.Pi/180.0)/2) / math.Cos(maxLat*(math.Pi/180.0))
+	if s >= 1 {
+		return 0, true
+	}
+	return 2 * math.Asin(s) * (180.0 / math.Pi), false
+}
+
+// Call fn for every point that could lie within the radius of (lat, lon).
+// Without a positive radius every point is a candidate.
+func (g *spatialGrid) forEachCandidate(lat, lon float64, fn func(i int)) {
+	if math.IsNaN(lat) || math.IsNaN(lon) || math.IsInf(lat, 0) || math.IsInf(lon, 0) {
+		return
+	}
+	if g.radiusKm <= 0 || lat < -90 || lat > 90 {
+		for i := range g.lats {
+			fn(i)
+		}
+		return
+	}
+	for _, i := range g.overflow {
+		fn(i)
+	}
+
+	// A point within the radius differs in latitude by at most cellDeg.
+	// One extra cell on each side absorbs floating point error.
+	latLo, latHi := g.latCell(lat-g.cellDeg)-1, g.latCell(lat+g.cellDeg)+1
+
+	dLon, allLon := g.lonWindow(lat)
+
+	// Near the poles, or when the window covers more cells than are
+	// populated, it is cheaper to walk the populated cells directly
+	rows := latHi - latLo + 1
+	if allLon || rows*(int(2*dLon/g.cellDeg)+4) > len(g.cells) {
+		for key, idx := range g.cells {
+			if key[0] >= latLo && key[0] <= latHi {
+				for _, i := range idx {
+					fn(i)
+				}
+			}
+		}
+		return
+	}
+
+	// Split the longitude window where it crosses the antimeridian
+	w := wrapLon(lon)
+	lo, hi := w-dLon, w+dLon
+	windows := [][2]float64{{lo, hi}}
+	if lo < 0 {
+		windows = [][2]float64{{lo + 360, 360}, {0, hi}}
+	} else if hi >= 360 {
+		windows = [][2]float64{{lo, 360}, {0, hi - 360}}
+	}
+	for latC := latLo; latC <= latHi; latC++ {
+		for _, win := range windows {
+			for c := g.lonCell(win[0]) - 1; c <= g.lonCell(win[1])+1; c++ {
+				lonC := ((c % g.nLon) + g.nLon) % g.nLon
+				for _, i := range g.cells[[2]int{latC, lonC}] {
+					fn(i)
+				}
+			}
+		}
+	}
+}
+
+// gridMatch is a candidate point returned by a grid query
+type gridMatch struct {
+	index    int
+	distance float64
+}
+
+// Return up to k points strictly within the radius, closest first. When the
+// radius is <= 0 the closest points at any distance are returned. Ties go to
+// the lowest index, matching a linear scan. Points for which skip (which may
+// be nil) returns true are ignored.
+func (g *spatialGrid) kNearest(lat, lon float64, k int, skip func(i int) bool) []gridMatch {
+	limit := g.radiusKm
+	if g.radiusKm <= 0 {
+		limit = math.Inf(1)
+	}
+	cosLat := math.Cos(lat * (math.Pi / 180.0))
+
+	// Bounding box around the query. Neighbouring cells still contain points
+	// that cannot be within the radius, and the box rejects them without a
+	// distance call. It is conservative, so matches are unchanged.
+	boxed := g.radiusKm > 0 && lat >= -90 && lat <= 90
+	boxLon, allLon := 0.0, true
+	if boxed {
+		boxLon, allLon = g.lonWindow(lat)
+	}
+	wrapped := wrapLon(lon)
+
+	best := make([]gridMatch, 0, k)
+	g.forEachCandidate(lat, lon, func(i int) {
+		if skip != nil && skip(i) {
+			return
+		}
+		if boxed && g.lats[i] >= -90 && g.lats[i] <= 90 {
+			if math.Abs(g.lats[i]-lat) > g.cellDeg {
+				return
+			}
+			if !allLon {
+				dLon := math.Abs(g.wrappedLons[i] - wrapped)
+				if dLon > 180 {
+					dLon = 360 - dLon
+				}
+				if dLon > boxLon {
+					return
+				}
+			}
+		}
+		distance := g.distanceTo(lat, lon, cosLat, i)
+		if !(distance < limit) {
+			return
+		}
+		pos := len(best)
+		for j, m := range best {
+			if m.index == i {
+				return // Already seen through an overlapping cell
+			}
+			if pos == len(best) && (distance < m.distance || (distance == m.distance && g.tieBefore(i, m.index))) {
+				pos = j
+			}
+		}
+		if pos == k {
+			return
+		}
+		if len(best) < k {
+			best = append(best, gridMatch{})
+		}
+		copy(best[pos+1:], best[pos:])
+		best[pos] = gridMatch{index: i, distance: distance}
+	})
+	return best
+}
+
+// Distance from (lat, lon), whose cosine of latitude is cosLat, to point i
+func (g *spatialGrid) distanceTo(lat, lon, cosLat float64, i int) float64 {
+	if g.distance == nil {
+		return haversineCos(lat, lon, cosLat, g.lats[i], g.lons[i], g.cosLats[i])
+	}
+	return g.distance(lat, lon, g.lats[i], g.lons[i])
+}
+
+// Count the points strictly within the radius (every point with valid
+// coordinates when the radius is <= 0), ignoring those skip rejects
+func (g *spatialGrid) countWithin(lat, lon float64, skip func(i int) bool) int {
+	limit := g.radiusKm
+	if g.radiusKm <= 0 {
+		limit = math.Inf(1)
+	}
+	cosLat := math.Cos(lat * (math.Pi / 180.0))
+
+	// Overlapping cells can report a point twice, so collect and dedupe
+	var within []int
+	count := 0
+	g.forEachCandidate(lat, lon, func(i int) {
+		if skip != nil && skip(i) {
+			return
+		}
+		if !(g.distanceTo(lat, lon, cosLat, i) < limit) {
+			return
+		}
+		if g.radiusKm <= 0 {
+			count++ // Every point is visited exactly once
+			return
+		}
+		within = append(within, i)
+	})
+	if g.radiusKm <= 0 {
+		return count
+	}
+	sort.Ints(within)
+	for j := range within {
+		if j == 0 || within[j] != within[j-1] {
+			count++
+		}
+	}
+	return count
+}
+
+// Report whether point i wins a distance tie against point j
+func (g *spatialGrid) tieBefore(i, j int) bool {
+	if g.tieLess != nil {
+		if g.tieLess(i, j) {
+			return true
+		}
+		if g.tieLess(j, i) {
+			return false
+		}
+	}
+	return i < j
+}
+
+// Run fn(i) for every i in [0, n) across runtime.NumCPU() goroutines, each
+// handling a contiguous block of indexes
+func parallelFor(n int, fn func(i int)) {
+	if n == 0 {
+		return
+	}
+	workers := runtime.NumCPU()
+	if workers > n {
+		workers = n
+	}
+	chunk := (n + workers - 1) / workers
+
+	var wg sync.WaitGroup
+	for start := 0; start < n; start += chunk {
+		end := start + chunk
+		if end > n {
+			end = n
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				fn(i)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+}
+
+// JoinType selects which unmatched rows joinDatasets keeps
+type JoinType int
+
+const (
+	InnerJoin JoinType = iota // Only matched rows
+	LeftJoin                  // Also unmatched CSV rows, with blank Excel columns
+	FullJoin                  // Also unmatched Excel rows, with blank CSV columns
+	AuditJoin                 // Every CSV row in file order, with a trailing matchedColumn
+)
+
+// Look up a join type by name
+func joinTypeFor(name string) (JoinType, error) {
+	switch strings.ToLower(name) {
+	case "inner":
+		return InnerJoin, nil
+	case "left":
+		return LeftJoin, nil
+	case "full":
+		return FullJoin, nil
+	case "audit":
+		return AuditJoin, nil
+	}
+	return InnerJoin, fmt.Errorf("unknown join type %q (want inner, left, full or audit)", name)
+}
+
+// TieBreak selects which of several Excel rows at exactly the same distance
+// from a CSV row is matched
+type TieBreak int
+
+const (
+	// The row that comes first in the Excel data (lowest row index)
+	TieByRowOrder TieBreak = iota
+	// The row with the smallest value in JoinOptions.TieBreakCol, compared
+	// as numbers when both parse and as text otherwise; rows with equal
+	// values fall back to row order
+	TieByColumn
+)
+
+// JoinOptions configures how CSV rows are matched to Excel rows
+type JoinOptions struct {
+	CSVLatCol, CSVLonCol     int
+	ExcelLatCol, ExcelLonCol int
+
+	// Match radius in km; <= 0 matches the nearest row at any distance
+	RadiusKm float64
+
+	// Distance in km between two points; nil means haversine
+	Distance func(lat1, lon1, lat2, lon2 float64) float64
+
+	// Remove an Excel row from the candidate pool once it has been matched,
+	// so no Excel row is joined more than once. Matching is greedy in CSV
+	// row order.
+	OneToOne bool
+
+	// Which unmatched rows to keep in the joined output (joinDatasets only)
+	Type JoinType
+
+	// Print progress to stderr every ProgressEvery CSV rows; 0 disables it
+	ProgressEvery int
+
+	// Optional key columns (e.g. operator name) whose values must also be
+	// equal, ignoring case and surrounding spaces, for a match to count.
+	// Set both to -1 to join on geography alone.
+	CSVKeyCol, ExcelKeyCol int
+
+	// How equidistant Excel rows are ordered, and the Excel column used by
+	// TieByColumn. Either way the result is the same on every run.
+	TieBreak    TieBreak
+	TieBreakCol int
+
+	// Also count, for every CSV row, the Excel rows within the radius (see
+	// KNearestResult.CandidateCounts). Rows already taken by OneToOne
+	// matching still count.
+	CountCandidates bool
+}
+
+// kNearestMatch is a CSV row together with its closest Excel rows
+type kNearestMatch struct {
+	CSVIndex  int // Position of CSVRow in csvData[1:]
+	CSVRow    []string
+	Matches   [][]string // Nearest first
+	Distances []float64  // Distance in km to each entry of Matches
+}
+
+// KNearestResult is the outcome of joinKNearest
+type KNearestResult struct {
+	Matches  []kNearestMatch
+	Dangling [][]string // CSV rows with no candidate
+
+	// CSV rows never searched because their coordinates don't parse or the
+	// row is too short for them. They are not dangling, but outer joins
+	// still keep them.
+	Skipped [][]string
+
+	// Number of times each Excel data row (excelData[1:]) was matched
+	MatchCounts []int
+
+	// With CountCandidates, the number of Excel rows within the radius of
+	// each CSV data row (csvData[1:]), or -1 when its coordinates don't parse
+	CandidateCounts []int
+}
+
+// Join each CSV row to up to k of its closest Excel rows within the radius,
+// sorted by distance. Rows whose coordinates do not parse are skipped on
+// both sides rather than treated as (0, 0), and counted. k < 1 is treated
+// as 1.
+func joinKNearest(csvData, excelData [][]string, opts JoinOptions, k int) KNearestResult {
+	if k < 1 {
+		k = 1
+	}
+
+	// Index the Excel coordinates so each CSV row only checks nearby candidates
+	excelRows := excelData[1:]
+	excelLats := make([]float64, len(excelRows))
+	excelLons := make([]float64, len(excelRows))
+	skippedExcel, shortExcel := 0, 0
+	for i, excelRow := range excelRows {
+		if !hasColumns(excelRow, opts.ExcelLatCol, opts.ExcelLonCol) {
+			excelLats[i], excelLons[i] = math.NaN(), math.NaN()
+			shortExcel++
+			continue
+		}
+		lat, lon, ok := parseLatLon(excelRow, opts.ExcelLatCol, opts.ExcelLonCol)
+		if !ok {
+			// NaN coordinates are never matched by the grid
+			lat, lon = math.NaN(), math.NaN()
+			skippedExcel++
+		}
+		excelLats[i], excelLons[i] = lat, lon
+	}
+	grid := newSpatialGrid(excelLats, excelLons, opts.RadiusKm, opts.Distance)
+	if opts.TieBreak == TieByColumn {
+		grid.tieLess = columnLess(excelRows, opts.TieBreakCol)
+	}
+
+	// Normalize the Excel keys once; rows without a key cell never match
+	keyed := opts.CSVKeyCol >= 0 && opts.ExcelKeyCol >= 0
+	var excelKeys []string
+	var excelHasKey []bool
+	if keyed {
+		excelKeys = make([]string, len(excelRows))
+		excelHasKey = make([]bool, len(excelRows))
+		for i, excelRow := range excelRows {
+			if opts.ExcelKeyCol < len(excelRow) {
+				excelKeys[i] = joinKey(excelRow[opts.ExcelKeyCol])
+				excelHasKey[i] = true
+			}
+		}
+	}
+
+	result := KNearestResult{MatchCounts: make([]int, len(excelRows))}
+	var used []bool
+	if opts.OneToOne {
+		used = make([]bool, len(excelRows))
+	}
+
+	// Search candidates for every CSV row. Rows are split across CPUs and each
+	// worker only writes its own slots, so the output order is deterministic.
+	// One-to-one matching depends on earlier matches and stays sequential.
+	csvRows := csvData[1:]
+	candidates := make([][]gridMatch, len(csvRows))
+	parsed := make([]bool, len(csvRows))
+	if opts.CountCandidates {
+		result.CandidateCounts = make([]int, len(csvRows))
+	}
+	var processed int64
+	search := func(i int) {
+		// Rows too short for the coordinate columns are skipped like unparsed ones
+		var csvLat, csvLon float64
+		ok := false
+		if hasColumns(csvRows[i], opts.CSVLatCol, opts.CSVLonCol) {
+			csvLat, csvLon, ok = parseLatLon(csvRows[i], opts.CSVLatCol, opts.CSVLonCol)
+		}
+		if ok {
+			parsed[i] = true
+			var keySkip, skip func(j int) bool
+			if keyed {
+				hasKey := opts.CSVKeyCol < len(csvRows[i])
+				key := ""
+				if hasKey {
+					key = joinKey(csvRows[i][opts.CSVKeyCol])
+				}
+				keySkip = func(j int) bool {
+					return !hasKey || !excelHasKey[j] || excelKeys[j] != key
+				}
+			}
+			switch {
+			case used != nil && keySkip != nil:
+				skip = func(j int) bool { return used[j] || keySkip(j) }
+			case used != nil:
+				skip = func(j int) bool { return used[j] }
+			default:
+				skip = keySkip
+			}
+			candidates[i] = grid.kNearest(csvLat, csvLon, k, skip)
+			if opts.CountCandidates {
+				result.CandidateCounts[i] = grid.countWithin(csvLat, csvLon, keySkip)
+			}
+		} else if opts.CountCandidates {
+			result.CandidateCounts[i] = -1
+		}
+		if opts.ProgressEvery > 0 {
+			done := atomic.AddInt64(&processed, 1)
+			if done%int64(opts.ProgressEvery) == 0 || done == int64(len(csvRows)) {
+				Logger.Printf("Joining: %d/%d CSV rows (%.1f%%)\n", done, len(csvRows), 100*float64(done)/float64(len(csvRows)))
+			}
+		}
+	}
+	if used == nil {
+		parallelFor(len(csvRows), search)
+	}
+
+	skippedCSV, shortCSV := 0, 0
+	for i, csvRow := range csvRows {
+		if used != nil {
+			search(i)
+		}
+		if !parsed[i] {
+			result.Skipped = append(result.Skipped, csvRow)
+			if hasColumns(csvRow, opts.CSVLatCol, opts.CSVLonCol) {
+				skippedCSV++
+			} else {
+				shortCSV++
+			}
+			continue
+		}
+
+		best := candidates[i]
+		if len(best) == 0 {
+			result.Dangling = append(result.Dangling, csvRow)
+			continue
+		}
+		match := kNearestMatch{CSVIndex: i, CSVRow: csvRow}
+		for _, m := range best {
+			match.Matches = append(match.Matches, excelRows[m.index])
+			match.Distances = append(match.Distances, m.distance)
+			result.MatchCounts[m.index]++
+			if used != nil {
+				used[m.index] = true
+			}
+		}
+		result.Matches = append(result.Matches, match)
+	}
+
+	if skippedCSV > 0 || skippedExcel > 0 {
+		Logger.Printf("Skipped rows with unparseable coordinates: %d in CSV, %d in Excel\n", skippedCSV, skippedExcel)
+	}
+	if shortCSV > 0 || shortExcel > 0 {
+		Logger.Printf("Skipped rows too short to hold the coordinate columns: %d in CSV, %d in Excel\n", shortCSV, shortExcel)
+	}
+
+	return result
+}
+
+// Order rows by one column, numerically when both cells parse as numbers
+// and as text otherwise. Rows too short for the column sort last.
+func columnLess(rows [][]string, col int) func(i, j int) bool {
+	values := make([]string, len(rows))
+	numbers := make([]float64, len(rows))
+	isNumber := make([]bool, len(rows))
+	present := make([]bool, len(rows))
+	for i, row := range rows {
+		if col >= 0 && col < len(row) {
+			present[i] = true
+			values[i] = row[col]
+			numbers[i], isNumber[i] = parseFloatStrict(row[col])
+		}
+	}
+	return func(i, j int) bool {
+		if present[i] != present[j] {
+			return present[i]
+		}
+		if isNumber[i] && isNumber[j] {
+			return numbers[i] < numbers[j]
+		}
+		return values[i] < values[j]
+	}
+}
+
+// Normalize a key cell for comparison
+func joinKey(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// Header of the column joinDatasets appends with each match distance
+const distanceColumn = "join_distance_km"
+
+// Name of the "true"/"false" column that audit joins append
+const matchedColumn = "matched"
+
+// JoinResult is the outcome of joinDatasets
+type JoinResult struct {
+	Header   []string   // CSV header, Excel header and distanceColumn (and matchedColumn for audit joins)
+	Joined   [][]string // CSV row, its matched Excel row and the match distance
+	Matched  int        // Number of rows in Joined that are actual matches (see MatchedRows)
+	Dangling [][]string // CSV rows with no match, whatever the join type
+
+	// Number of times each Excel data row (excelData[1:]) was matched.
+	// Counts above one mean the same Excel flare was joined repeatedly.
+	MatchCounts []int
+}
+
+// Rows of Joined that are actual matches. They come first, except in audit
+// joins, where they are the rows marked as matched.
+func (r JoinResult) MatchedRows() [][]string {
+	if len(r.Header) == 0 || r.Header[len(r.Header)-1] != matchedColumn {
+		return r.Joined[:r.Matched]
+	}
+	rows := make([][]string, 0, r.Matched)
+	for _, row := range r.Joined {
+		if row[len(row)-1] == "true" {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// Number of Excel rows that were matched more than once
+func (r JoinResult) DuplicateMatches() int {
+	dupes := 0
+	for _, c := range r.MatchCounts {
+		if c > 1 {
+			dupes++
+		}
+	}
+	return dupes
+}
+
+// Copy a row, padding it with empty strings up to width columns so the
+// columns that follow it line up with the header
+func padRow(row []string, width int) []string {
+	padded := append([]string{}, row...)
+	for len(padded) < width {
+		padded = append(padded, "")
+	}
+	return padded
+}
+
+// Join datasets within radius clustering. Each CSV row is joined to its
+// closest Excel row within opts.RadiusKm; see JoinOptions for the details.
+// Matched rows come first in CSV order, followed for outer joins by the
+// unmatched CSV rows and then (full joins) the unmatched Excel rows. Audit
+// joins instead keep every CSV row in file order, marking each as matched
+// or not in a trailing column.
+func joinDatasets(csvData, excelData [][]string, opts JoinOptions) (JoinResult, error) {
+	if err := checkJoinInput(csvData, excelData); err != nil {
+		return JoinResult{}, err
+	}
+	return joinResultFrom(csvData, excelData, opts, joinKNearest(csvData, excelData, opts, 1)), nil
+}
+
+// Check that both datasets have a header row and at least one data row
+func checkJoinInput(csvData, excelData [][]string) error {
+	for _, d := range []struct {
+		label string
+		data  [][]string
+	}{{"CSV", csvData}, {"Excel", excelData}} {
+		switch len(d.data) {
+		case 0:
+			return fmt.Errorf("cannot join: the %s data is empty, with no header row", d.label)
+		case 1:
+			return fmt.Errorf("cannot join: the %s data has a header but no data rows", d.label)
+		}
+	}
+	return nil
+}
+
+// Join datasets like joinDatasets, also returning for each CSV data row
+// (csvData[1:]) how many Excel rows were within the radius, though only the
+// closest is joined. Rows with zero end up dangling; -1 marks rows whose
+// coordinates don't parse.
+func joinDatasetsWithCounts(csvData, excelData [][]string, opts JoinOptions) (JoinResult, []int, error) {
+	if err := checkJoinInput(csvData, excelData); err != nil {
+		return JoinResult{}, nil, err
+	}
+	opts.CountCandidates = true
+	nearest := joinKNearest(csvData, excelData, opts, 1)
+	return joinResultFrom(csvData, excelData, opts, nearest), nearest.CandidateCounts, nil
+}
+
+// Header of the rows joinDatasets produces for the given headers
+func joinHeader(csvHeader, excelHeader []string, opts JoinOptions) []string {
+	header := append(append(append([]string{}, csvHeader...), excelHeader...), distanceColumn)
+	if opts.Type == AuditJoin {
+		header = append(header, matchedColumn)
+	}
+	return header
+}
+
+// Build the joined table from the single nearest match of each CSV row
+func joinResultFrom(csvData, excelData [][]string, opts JoinOptions, nearest KNearestResult) JoinResult {
+	result := JoinResult{
+		Header:      joinHeader(csvData[0], excelData[0], opts),
+		Matched:     len(nearest.Matches),
+		Dangling:    nearest.Dangling,
+		MatchCounts: nearest.MatchCounts,
+	}
+	emitJoinedRows(csvData, excelData, opts, nearest, func(joinedRow []string) error {
+		result.Joined = append(result.Joined, joinedRow)
+		return nil
+	})
+
+	return result
+}
+
+// Join datasets like joinDatasets, but hand each joined row to emit as it
+// is built instead of collecting them, so output can be written
+// incrementally. The rows and their order are those of JoinResult.Joined,
+// under joinHeader. Returns the dangling CSV rows, or the first error from
+// emit, which stops the join.
+func joinDatasetsFunc(csvData, excelData [][]string, opts JoinOptions, emit func(joinedRow []string) error) ([][]string, error) {
+	if err := checkJoinInput(csvData, excelData); err != nil {
+		return nil, err
+	}
+	nearest := joinKNearest(csvData, excelData, opts, 1)
+	if err := emitJoinedRows(csvData, excelData, opts, nearest, emit); err != nil {
+		return nil, err
+	}
+	return nearest.Dangling, nil
+}
+
+// Build the joined rows for the join type and pass them to emit in order:
+// matched rows in CSV order, then for outer joins the unmatched CSV rows,
+// the CSV rows skipped for their coordinates and (full joins) the unmatched
+// Excel rows, padding the missing side with blanks. Audit joins instead go through every CSV row in file order,
+// appending "true" or "false" for whether it matched.
+func emitJoinedRows(csvData, excelData [][]string, opts JoinOptions, nearest KNearestResult, emit func(joinedRow []string) error) error {
+	csvWidth, excelWidth := len(csvData[0]), len(excelData[0])
+	matchedRow := func(m kNearestMatch) []string {
+		joinedRow := append(padRow(m.CSVRow, csvWidth), padRow(m.Matches[0], excelWidth)...)
+		return append(joinedRow, strconv.FormatFloat(m.Distances[0], 'f', 3, 64))
+	}
+	unmatchedCSVRow := func(csvRow []string) []string {
+		return append(padRow(csvRow, csvWidth), make([]string, excelWidth+1)...)
+	}
+
+	if opts.Type == AuditJoin {
+		// Matches are in CSV order, so merge them into the CSV rows as we go
+		next := 0
+		for i, csvRow := range csvData[1:] {
+			var joinedRow []string
+			if next < len(nearest.Matches) && nearest.Matches[next].CSVIndex == i {
+				joinedRow = append(matchedRow(nearest.Matches[next]), "true")
+				next++
+			} else {
+				joinedRow = append(unmatchedCSVRow(csvRow), "false")
+			}
+			if err := emit(joinedRow); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, m := range nearest.Matches {
+		if err := emit(matchedRow(m)); err != nil {
+			return err
+		}
+	}
+	if opts.Type == LeftJoin || opts.Type == FullJoin {
+		for _, rows := range [][][]string{nearest.Dangling, nearest.Skipped} {
+			for _, csvRow := range rows {
+				if err := emit(unmatchedCSVRow(csvRow)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if opts.Type == FullJoin {
+		for i, excelRow := range excelData[1:] {
+			if nearest.MatchCounts[i] == 0 {
+				joinedRow := append(make([]string, csvWidth), padRow(excelRow, excelWidth)...)
+				if err := emit(append(joinedRow, "")); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Print, for up to limit dangling CSV rows, the closest Excel row at any
+// distance, so a failed join can be told apart as a radius that is too small
+// or coordinates that are wrong. Key columns are still honoured, and
+// rows with no candidate at all are reported as such.
+func explainDangling(w io.Writer, csvHeader []string, dangling, excelData [][]string, opts JoinOptions, limit int) {
+	if len(dangling) == 0 || len(excelData) < 2 {
+		return
+	}
+	if limit < len(dangling) {
+		dangling = dangling[:limit]
+	}
+	opts.RadiusKm = 0 // Nearest at any distance
+	opts.OneToOne = false
+	opts.ProgressEvery = 0
+	opts.CountCandidates = false
+	nearest := joinKNearest(append([][]string{csvHeader}, dangling...), excelData, opts, 1)
+
+	fmt.Fprintf(w, "Closest Excel rows to %d dangling records:\n", len(dangling))
+	for _, m := range nearest.Matches {
+		fmt.Fprintf(w, "%v\n  nearest %v at %.3fkm\n", m.CSVRow, m.Matches[0], m.Distances[0])
+	}
+	for _, row := range nearest.Dangling {
+		fmt.Fprintf(w, "%v\n  no Excel row with valid coordinates (and a matching key)\n", row)
+	}
+}
+
+// Print how many CSV rows had 0, 1, 2, ... Excel rows within the radius,
+// grouping maxBucket and above into a single line
+func printCandidateHistogram(w io.Writer, counts []int, maxBucket int) {
+	buckets := make([]int, maxBucket+1)
+	unparsed := 0
+	for _, c := range counts {
+		switch {
+		case c < 0:
+			unparsed++
+		case c >= maxBucket:
+			buckets[maxBucket]++
+		default:
+			buckets[c]++
+		}
+	}
+
+	fmt.Fprintln(w, "Excel candidates within the radius per CSV row:")
+	for c, n := range buckets {
+		label := strconv.Itoa(c)
+		if c == maxBucket {
+			label += "+"
+		}
+		fmt.Fprintf(w, "%6s  %d\n", label, n)
+	}
+	if unparsed > 0 {
+		fmt.Fprintf(w, "%6s  %d\n", "n/a", unparsed)
+	}
+}
+
+// Spatially join several datasets in sequence: datasets[0] is joined to
+// datasets[1] with steps[0], the result to datasets[2] with steps[1], and so
+// on. In each step the CSV* columns of the options refer to the accumulated
+// table, whose columns are those of every dataset joined so far in order, so
+// the first dataset's columns keep their indexes throughout. The Excel*
+// columns refer to the dataset being added. Each step appends its own
+// distance column, named join_distance_km_1, join_distance_km_2, ...
+// The returned table has the accumulated header as row 0.
+func joinMany(datasets [][][]string, steps []JoinOptions) ([][]string, error) {
+	if len(datasets) < 2 {
+		return nil, fmt.Errorf("need at least two datasets to join, got %d", len(datasets))
+	}
+	if len(steps) != len(datasets)-1 {
+		return nil, fmt.Errorf("got %d join steps for %d datasets, want %d", len(steps), len(datasets), len(datasets)-1)
+	}
+	for i, data := range datasets {
+		if len(data) == 0 {
+			return nil, fmt.Errorf("dataset %d has no header row", i)
+		}
+	}
+
+	joined := datasets[0]
+	for i, opts := range steps {
+		result, err := joinDatasets(joined, datasets[i+1], opts)
+		if err != nil {
+			return nil, fmt.Errorf("error in join step %d: %w", i+1, err)
+		}
+		header := result.Header
+		header[len(joined[0])+len(datasets[i+1][0])] = fmt.Sprintf("%s_%d", distanceColumn, i+1)
+		joined = append([][]string{header}, result.Joined...)
+	}
+	return joined, nil
+}
+
+// Pipeline runs the filter, join and regression steps on data already in
+// memory, each dataset as rows with its header first. Loading files is left
+// to the caller (see loadData).
+type Pipeline struct {
+	CSV, Excel [][]string
+
+	// Country columns used by Filter
+	CSVCountryCol, ExcelCountryCol int
+
+	// Options for Join
+	Options JoinOptions
+
+	// Outcome of the last Join
+	Result JoinResult
+}
+
+// Create a pipeline over two datasets, each with its header as row 0
+func NewPipeline(csvData, excelData [][]string, csvCountryCol, excelCountryCol int, opts JoinOptions) (*Pipeline, error) {
+	if len(csvData) == 0 || len(excelData) == 0 {
+		return nil, fmt.Errorf("both datasets need at least a header row")
+	}
+	return &Pipeline{
+		CSV:             csvData,
+		Excel:           excelData,
+		CSVCountryCol:   csvCountryCol,
+		ExcelCountryCol: excelCountryCol,
+		Options:         opts,
+	}, nil
+}
+
+// Keep only rows of the given countries in both datasets, headers included
+func (p *Pipeline) Filter(countries []string) {
+	p.CSV = append([][]string{p.CSV[0]}, filterByCountries(p.CSV[1:], p.CSVCountryCol, countries)...)
+	p.Excel = append([][]string{p.Excel[0]}, filterByCountries(p.Excel[1:], p.ExcelCountryCol, countries)...)
+}
+
+// Join the datasets with the pipeline's options, keeping the result for Regress
+func (p *Pipeline) Join() (JoinResult, error) {
+	result, err := joinDatasets(p.CSV, p.Excel, p.Options)
+	if err != nil {
+		return JoinResult{}, err
+	}
+	p.Result = result
+	return p.Result, nil
+}
+
+// Regress a column of the joined rows on other columns, using the matched
+// rows of the last Join. Columns are indexes into the joined header.
+func (p *Pipeline) Regress(targetCol int, predictorCols []int, scaling string, imputeMissing bool) (RegressionResult, error) {
+	if p.Result.Header == nil {
+		return RegressionResult{}, fmt.Errorf("no joined data: call Join before Regress")
+	}
+	y, x := extractRegressionData(p.Result.MatchedRows(), targetCol, predictorCols, imputeMissing, false)
+	result, err := runRegression(y, x, nil, scaling)
+	if err != nil {
+		return RegressionResult{}, err
+	}
+	for _, idx := range predictorCols {
+		if idx < len(p.Result.Header) {
+			result.Predictors = append(result.Predictors, p.Result.Header[idx])
+		} else {
+			result.Predictors = append(result.Predictors, fmt.Sprintf("column %d", idx))
+		}
+	}
+	return result, nil
+}
+
+// Report whether a cell is empty or only whitespace
+func isBlank(cell string) bool {
+	return strings.TrimSpace(cell) == ""
+}
+
+// Drop rows whose target cell is blank, and unless keepBlankPredictors is
+// set also rows with a blank predictor cell, returning the kept rows. Rows
+// too short for a column are kept; see extractRegressionData.
+func dropBlankRows(rows [][]string, targetCol int, predictorCols []int, keepBlankPredictors bool) [][]string {
+	var kept [][]string
+	for _, row := range rows {
+		blank := targetCol < len(row) && isBlank(row[targetCol])
+		for _, idx := range predictorCols {
+			if !keepBlankPredictors && idx < len(row) && isBlank(row[idx]) {
+				blank = true
+			}
+		}
+		if !blank {
+			kept = append(kept, row)
+		}
+	}
+	return kept
+}
+
+// Extract regression data. Rows too short for the target are skipped. When
+// imputeMissing is set, predictor cells missing from short rows are filled
+// with the mean of that predictor over the rows that have it, so every row
+// has one value per predictor; otherwise missing cells are left out.
+// Blank cells parse as zero unless blankMissing is set: then rows with a
+// blank target are skipped, and blank predictor cells are imputed like
+// missing ones or, without imputeMissing, skip their row too.
+func extractRegressionData(joinedData [][]string, targetIndex int, independentIndexes []int, imputeMissing, blankMissing bool) ([]float64, [][]float64) {
+	var target []float64
+	var predictors [][]float64
+	if blankMissing {
+		joinedData = dropBlankRows(joinedData, targetIndex, independentIndexes, imputeMissing)
+	}
+
+	sums := make([]float64, len(independentIndexes))
+	counts := make([]int, len(independentIndexes))
+	for _, row := range joinedData {
+		if len(row) > targetIndex {
+			y := parseFloat(row[targetIndex])
+			target = append(target, y)
+
+			var x []float64
+			for j, idx := range independentIndexes {
+				if len(row) > idx && blankMissing && isBlank(row[idx]) {
+					x = append(x, math.NaN()) // Only kept when imputing; filled in below
+				} else if len(row) > idx {
+					val := parseFloat(row[idx])
+					x = append(x, val)
+					sums[j] += val
+					counts[j]++
+				} else if imputeMissing {
+					x = append(x, math.NaN()) // Filled in below
+				}
+			}
+			predictors = append(predictors, x)
+		}
+	}
+
+	if imputeMissing {
+		for j := range independentIndexes {
+			mean := 0.0 // A predictor with no values at all imputes as zero
+			if counts[j] > 0 {
+				mean = sums[j] / float64(counts[j])
+			}
+			for _, x := range predictors {
+				if math.IsNaN(x[j]) {
+					x[j] = mean
+				}
+			}
+		}
+	}
+	return target, predictors
+}
+
+// Drop rows whose y lies outside the lowPct and highPct percentiles of y
+// (0-100, linearly interpolated), keeping y and x aligned. Also returns the
+// original indexes of the kept rows, to filter any other per-row data.
+func clipOutliers(y []float64, x [][]float64, lowPct, highPct float64) ([]float64, [][]float64, []int) {
+	if len(y) == 0 {
+		return y, x, nil
+	}
+	sorted := append([]float64(nil), y...)
+	sort.Float64s(sorted)
+	low := stat.Quantile(lowPct/100, stat.LinInterp, sorted, nil)
+	high := stat.Quantile(highPct/100, stat.LinInterp, sorted, nil)
+
+	var yKept []float64
+	var xKept [][]float64
+	var kept []int
+	for i, val := range y {
+		if val >= low && val <= high {
+			yKept = append(yKept, val)
+			xKept = append(xKept, x[i])
+			kept = append(kept, i)
+		}
+	}
+	return yKept, xKept, kept
+}
+
+// QuantileTransform maps a skewed target onto a standard normal
+// distribution by rank: the i-th smallest of n values becomes the normal
+// quantile of (i-0.5)/n. It keeps the sorted original values so fitted
+// values on the normal scale can be mapped back. A regression on the
+// transformed target describes its normal scores, not the original units.
+type QuantileTransform struct {
+	Sorted []float64 // Original values in ascending order
+}
+
+// Fit a quantile transform to y and return y on the normal scale. Tied
+// values share the average of their ranks.
+func newQuantileTransform(y []float64) (*QuantileTransform, []float64) {
+	sorted := append([]float64(nil), y...)
+	sort.Float64s(sorted)
+
+	n := float64(len(y))
+	scores := ranks(y)
+	for i, r := range scores {
+		scores[i] = distuv.UnitNormal.Quantile((r - 0.5) / n)
+	}
+	return &QuantileTransform{Sorted: sorted}, scores
+}
+
+// Map a value on the normal scale back to the original units, linearly
+// interpolating between the fitted values and clamping beyond them
+func (q *QuantileTransform) Inverse(z float64) float64 {
+	n := len(q.Sorted)
+	if n == 0 {
+		return math.NaN()
+	}
+	pos := distuv.UnitNormal.CDF(z)*float64(n) - 0.5 // 0-based index of the quantile
+	if !(pos > 0) {
+		return q.Sorted[0]
+	}
+	if pos >= float64(n-1) {
+		return q.Sorted[n-1]
+	}
+	i := int(pos)
+	frac := pos - float64(i)
+	return q.Sorted[i] + frac*(q.Sorted[i+1]-q.Sorted[i])
+}
+
+// One-hot encode a categorical column: one 0/1 column per distinct value,
+// in sorted order, except the first, which is the baseline every other
+// level is compared against (including all of them would be collinear with
+// the intercept). Rows too short for the column are all zeros. Returns the
+// dummy rows and the level each dummy column stands for.
+func oneHotEncode(data [][]string, col int) ([][]float64, []string) {
+	seen := make(map[string]bool)
+	for _, row := range data {
+		if col < len(row) {
+			seen[row[col]] = true
+		}
+	}
+	var levels []string
+	for level := range seen {
+		levels = append(levels, level)
+	}
+	sort.Strings(levels)
+	if len(levels) > 0 {
+		levels = levels[1:]
+	}
+
+	position := make(map[string]int, len(levels))
+	for j, level := range levels {
+		position[level] = j
+	}
+	dummies := make([][]float64, len(data))
+	for i, row := range data {
+		dummies[i] = make([]float64, len(levels))
+		if col < len(row) {
+			if j, ok := position[row[col]]; ok {
+				dummies[i][j] = 1
+			}
+		}
+	}
+	return dummies, levels
+}
+
+// Weight rows by join distance so closer matches count more: a match at
+// distance d gets weight 1/(1+d/halfKm), halving at d = halfKm
+func distanceWeights(distancesKm []float64, halfKm float64) []float64 {
+	weights := make([]float64, len(distancesKm))
+	for i, d := range distancesKm {
+		weights[i] = 1 / (1 + math.Max(d, 0)/halfKm)
+	}
+	return weights
+}
+
+// Extract regression data by column name, resolving the target and predictor
+// names against the joined header (case-insensitive). See
+// extractRegressionData for how short rows are handled.
+func extractRegressionDataByName(header []string, joinedData [][]string, targetName string, predictorNames []string, imputeMissing bool) ([]float64, [][]float64, error) {
+	targetIndex, err := colIndex(header, targetName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("target column: %w", err)
+	}
+	independentIndexes := make([]int, len(predictorNames))
+	for j, name := range predictorNames {
+		if independentIndexes[j], err = colIndex(header, name); err != nil {
+			return nil, nil, fmt.Errorf("predictor column: %w", err)
+		}
+	}
+	y, x := extractRegressionData(joinedData, targetIndex, independentIndexes, imputeMissing, false)
+	return y, x, nil
+}
+
+// Normalize a slice using Min-Max Scaling.
+// An empty input returns an empty slice instead of panicking, and a
+// constant input (max == min) returns all zeros instead of NaN.
+func normalize(data []float64) []float64 {
+	if len(data) == 0 {
+		return []float64{}
+	}
+	center, scale := minMaxParams(data)
+	return applyScale(data, center, scale)
+}
+
+// Smallest and largest value of a non-empty slice
+func minMax(data []float64) (float64, float64) {
+	minVal, maxVal := data[0], data[0]
+	for _, val := range data {
+		if val < minVal {
+			minVal = val
+		}
+		if val > maxVal {
+			maxVal = val
+		}
+	}
+	return minVal, maxVal
+}
+
+// Standardize a slice to zero mean and unit standard deviation (Z-score).
+// An empty input returns an empty slice, and a zero-variance input returns
+// all zeros instead of NaN.
+func standardize(data []float64) []float64 {
+	if len(data) == 0 {
+		return []float64{}
+	}
+	center, scale := zScoreParams(data)
+	return applyScale(data, center, scale)
+}
+
+// Scale a slice robustly by subtracting the median and dividing by the
+// interquartile range, so a few huge values do not squash the rest.
+// An empty input returns an empty slice, and a zero IQR returns all zeros.
+func robustScale(data []float64) []float64 {
+	if len(data) == 0 {
+		return []float64{}
+	}
+	center, scale := robustParams(data)
+	return applyScale(data, center, scale)
+}
+
+// Center and scale of each scaling method for a non-empty slice
+func minMaxParams(data []float64) (float64, float64) {
+	minVal, maxVal := minMax(data)
+	return minVal, maxVal - minVal
+}
+
+func zScoreParams(data []float64) (float64, float64) {
+	var rs RunningStats
+	for _, val := range data {
+		rs.Add(val)
+	}
+	return rs.Mean(), rs.StdDev()
+}
+
+// RunningStats accumulates the mean and variance of a stream of values in
+// constant memory using Welford's algorithm, so statistics can be taken over
+// rows as they are streamed. The zero value is ready to use.
+type RunningStats struct {
+	n    int
+	mean float64
+	m2   float64 // Sum of squared differences from the current mean
+}
+
+// Add a value to the statistics
+func (r *RunningStats) Add(x float64) {
+	r.n++
+	delta := x - r.mean
+	r.mean += delta / float64(r.n)
+	r.m2 += delta * (x - r.mean)
+}
+
+// Number of values added
+func (r *RunningStats) Count() int {
+	return r.n
+}
+
+// Mean of the values added; NaN when there are none
+func (r *RunningStats) Mean() float64 {
+	if r.n == 0 {
+		return math.NaN()
+	}
+	return r.mean
+}
+
+// Sample (n-1) variance of the values added; NaN with fewer than two
+func (r *RunningStats) Variance() float64 {
+	if r.n < 2 {
+		return math.NaN()
+	}
+	return r.m2 / float64(r.n-1)
+}
+
+// Sample standard deviation of the values added; NaN with fewer than two
+func (r *RunningStats) StdDev() float64 {
+	return math.Sqrt(r.Variance())
+}
+
+func robustParams(data []float64) (float64, float64) {
+	sorted := append([]float64(nil), data...)
+	sort.Float64s(sorted)
+	median := stat.Quantile(0.5, stat.LinInterp, sorted, nil)
+	iqr := stat.Quantile(0.75, stat.LinInterp, sorted, nil) - stat.Quantile(0.25, stat.LinInterp, sorted, nil)
+	return median, iqr
+}
+
+// Map each value to (val - center) / scale, or to zero when the scale is
+// not positive (a constant column)
+func applyScale(data []float64, center, scale float64) []float64 {
+	scaled := make([]float64, len(data))
+	if !(scale > 0) {
+		return scaled
+	}
+	for i, val := range data {
+		scaled[i] = (val - center) / scale
+	}
+	return scaled
+}
+
+// Scaling methods accepted by runRegression
+const (
+	scalingMinMax = "minmax"
+	scalingZScore = "zscore"
+	scalingRobust = "robust"
+)
+
+// Scaler holds per-column scaling parameters fitted on one dataset, so the
+// same transformation can be applied to another (e.g. a held-out test set)
+// without recomputing it there
+type Scaler struct {
+	Method string
+	Center []float64 // Subtracted from each column: min, mean or median
+	Scale  []float64 // Then divided by: range, standard deviation or IQR
+}
+
+// Return an unfitted Scaler for a scaling method
+func scalerFor(method string) (*Scaler, error) {
+	switch method {
+	case scalingMinMax, scalingZScore, scalingRobust:
+		return &Scaler{Method: method}, nil
+	}
+	return nil, fmt.Errorf("unknown scaling method %q (want %q, %q or %q)", method, scalingMinMax, scalingZScore, scalingRobust)
+}
+
+// Fit the center and scale of every column of a rectangular matrix
+func (s *Scaler) Fit(x [][]float64) error {
+	if len(x) == 0 {
+		return fmt.Errorf("cannot fit a scaler to no rows")
+	}
+	params := minMaxParams
+	switch s.Method {
+	case scalingZScore:
+		params = zScoreParams
+	case scalingRobust:
+		params = robustParams
+	}
+	k := len(x[0])
+	s.Center, s.Scale = make([]float64, k), make([]float64, k)
+	for j := 0; j < k; j++ {
+		s.Center[j], s.Scale[j] = params(column(x, j))
+	}
+	return nil
+}
+
+// Scale rows with the fitted parameters. Columns that were constant when
+// fitted map to zero.
+func (s *Scaler) Transform(x [][]float64) ([][]float64, error) {
+	scaled := make([][]float64, len(x))
+	for i, row := range x {
+		if len(row) != len(s.Center) {
+			return nil, fmt.Errorf("row %d has %d values, the scaler was fitted on %d", i, len(row), len(s.Center))
+		}
+		scaled[i] = make([]float64, len(row))
+		for j, val := range row {
+			if s.Scale[j] > 0 {
+				scaled[i][j] = (val - s.Center[j]) / s.Scale[j]
+			}
+		}
+	}
+	return scaled, nil
+}
+
+// Map a scaled value of column j back to original units
+func (s *Scaler) Inverse(j int, scaled float64) float64 {
+	if !(s.Scale[j] > 0) {
+		return s.Center[j]
+	}
+	return s.Center[j] + scaled*s.Scale[j]
+}
+
+// Fit a scaler for a method on x and return the scaled x
+func fitTransform(method string, x [][]float64) (*Scaler, [][]float64, error) {
+	scaler, err := scalerFor(method)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := scaler.Fit(x); err != nil {
+		return nil, nil, err
+	}
+	scaled, err := scaler.Transform(x)
+	if err != nil {
+		return nil, nil, err
+	}
+	return scaler, scaled, nil
+}
+
+// Expand a single predictor into its powers 1..degree (one column each), for
+// polynomial fits through the multiple regression path. x is min-max scaled
+// before raising it to powers, and each power column is scaled again, so the
+// design matrix stays well conditioned. degree < 1 is treated as 1.
+func polynomialFeatures(x []float64, degree int) [][]float64 {
+	if degree < 1 {
+		degree = 1
+	}
+	base := normalize(x)
+	features := make([][]float64, len(x))
+	for i, val := range base {
+		features[i] = make([]float64, degree)
+		power := 1.0
+		for d := 0; d < degree; d++ {
+			power *= val
+			features[i][d] = power
+		}
+	}
+	return scaleColumns(features, normalize)
+}
+
+// Extract column j from a row-major matrix
+func column(x [][]float64, j int) []float64 {
+	col := make([]float64, len(x))
+	for i, row := range x {
+		col[i] = row[j]
+	}
+	return col
+}
+
+// Scale each column of a row-major matrix independently
+func scaleColumns(x [][]float64, scale func([]float64) []float64) [][]float64 {
+	scaled := make([][]float64, len(x))
+	for i := range x {
+		scaled[i] = make([]float64, len(x[i]))
+	}
+	if len(x) == 0 {
+		return scaled
+	}
+	for j := range x[0] {
+		for i, val := range scale(column(x, j)) {
+			scaled[i][j] = val
+		}
+	}
+	return scaled
+}
+
+// RegressionResult holds the fitted model and its goodness of fit
+type RegressionResult struct {
+	Intercept    float64
+	Coefficients []float64 // One per predictor, in column order
+	RSquared     float64
+	AdjRSquared  float64   // Adjusted for the number of predictors; NaN when n-k-1 <= 0
+	Spearman     float64   // Rank correlation between the target and the fitted values
+	MAE          float64   // Mean absolute error of the fitted values, in target units
+	RMSE         float64   // Root mean squared error of the fitted values, in target units
+	N            int       // Number of observations used in the fit
+	Predictors   []string  // Optional predictor names, indexed like Coefficients
+	Scaling      string    // Normalization method applied to the predictors
+	Weights      []float64 // Row weights of a weighted fit; nil for ordinary least squares
+
+	// Set for a Huber robust fit (see runHuberRegression), with the number
+	// of reweighting iterations it took
+	Huber           bool
+	HuberIterations int
+
+	// Fitted values and residuals (y - fitted) for every observation
+	Predicted []float64
+	Residuals []float64
+
+	// Standard errors, t-statistics and two-sided p-values, indexed like
+	// Coefficients. They are NaN when there are no residual degrees of freedom.
+	StdErrors []float64
+	TStats    []float64
+	PValues   []float64
+
+	InterceptStdError float64
+	InterceptTStat    float64
+	InterceptPValue   float64
+
+	// Overall F-test that all coefficients are zero; NaN when there are no
+	// residual degrees of freedom
+	FStatistic float64
+	FPValue    float64
+
+	// Ranges of the target and of each predictor before scaling, so scaled
+	// values can be mapped back to original units (see Denormalize)
+	TargetMin, TargetMax       float64
+	PredictorMin, PredictorMax []float64
+
+	// Predictor scaling fitted on the training data
+	Scaler *Scaler
+
+	// Set when the target was quantile-normalized before fitting; the
+	// coefficients and fitted values are then on the normal scale
+	TargetTransform *QuantileTransform
+
+	// Out-of-sample fit on a held-out test set; only set when TestN > 0
+	TestN        int
+	TestRSquared float64
+
+	// Mean and standard deviation of the out-of-sample R-squared across
+	// cross-validation folds (see crossValidate); only set when CVFolds > 0
+	CVFolds          int
+	CVRSquaredMean   float64
+	CVRSquaredStdDev float64
+
+	// (X'X)^-1 of the design matrix (intercept first) and the residual
+	// variance and degrees of freedom, kept for prediction intervals.
+	// xtxInv is nil when the fit has no residual degrees of freedom.
+	xtxInv           *mat.Dense
+	residualVariance float64
+	residualDF       int
+}
+
+// Perform multiple linear regression with per-column normalization.
+// scaling selects the normalization: "minmax", "zscore" or "robust".
+// Non-nil weights give a weighted least-squares fit, one weight per row.
+func runRegression(y []float64, x [][]float64, weights []float64, scaling string) (RegressionResult, error) {
+	if err := checkRegressionInput(y, x, weights); err != nil {
+		return RegressionResult{}, err
+	}
+	// Normalize x values column by column
+	scaler, xNorm, err := fitTransform(scaling, x)
+	if err != nil {
+		return RegressionResult{}, err
+	}
+	result, err := fitRegression(y, xNorm, weights, scaling)
+	if err != nil {
+		return RegressionResult{}, err
+	}
+	result.Scaler = scaler
+	result.setRanges(y, x)
+	return result, nil
+}
+
+// Tuning constant of the Huber loss, in units of the residual scale: 95%
+// efficiency for normally distributed errors
+const huberK = 1.345
+
+// Fit a Huber robust regression by iteratively reweighted least squares:
+// rows whose residual exceeds huberK robust standard deviations get their
+// weight cut in proportion, so a few giant values no longer dominate the
+// fit. Any row weights multiply the Huber weights, and the final combined
+// weights are kept in the result.
+func runHuberRegression(y []float64, x [][]float64, weights []float64, scaling string) (RegressionResult, error) {
+	if err := checkRegressionInput(y, x, weights); err != nil {
+		return RegressionResult{}, err
+	}
+	scaler, xNorm, err := fitTransform(scaling, x)
+	if err != nil {
+		return RegressionResult{}, err
+	}
+
+	const maxIterations, tolerance = 50, 1e-8
+	result, err := fitRegression(y, xNorm, weights, scaling)
+	if err != nil {
+		return RegressionResult{}, err
+	}
+	combined := make([]float64, len(y))
+	iterations := 0
+	for iterations < maxIterations {
+		// Robust residual scale: median absolute deviation, made consistent
+		// with the standard deviation of normal errors
+		abs := make([]float64, len(result.Residuals))
+		for i, r := range result.Residuals {
+			abs[i] = math.Abs(r)
+		}
+		sort.Float64s(abs)
+		scale := stat.Quantile(0.5, stat.Empirical, abs, nil) / 0.6745
+		if !(scale > 0) {
+			break // Most rows fit exactly; nothing left to downweight
+		}
+
+		for i, r := range result.Residuals {
+			combined[i] = 1
+			if u := math.Abs(r) / scale; u > huberK {
+				combined[i] = huberK / u
+			}
+			if weights != nil {
+				combined[i] *= weights[i]
+			}
+		}
+		next, err := fitRegression(y, xNorm, combined, scaling)
+		if err != nil {
+			return RegressionResult{}, err
+		}
+		iterations++
+
+		change := math.Abs(next.Intercept - result.Intercept)
+		for j, c := range next.Coefficients {
+			change = math.Max(change, math.Abs(c-result.Coefficients[j]))
+		}
+		result = next
+		if change < tolerance {
+			break
+		}
+	}
+	result.Huber, result.HuberIterations = true, iterations
+	result.Scaler = scaler
+	result.setRanges(y, x)
+	return result, nil
+}
+
+// Record the ranges of the unscaled target and predictors
+func (r *RegressionResult) setRanges(y []float64, x [][]float64) {
+	r.TargetMin, r.TargetMax = minMax(y)
+	r.PredictorMin = make([]float64, len(x[0]))
+	r.PredictorMax = make([]float64, len(x[0]))
+	for j := range r.PredictorMin {
+		r.PredictorMin[j], r.PredictorMax[j] = minMax(column(x, j))
+	}
+}
+
+// Compute MAE and RMSE from the residuals, on the target's original scale
+// when it was quantile-normalized. Rows count equally, even in weighted fits.
+func (r *RegressionResult) setErrors() {
+	sumAbs, sumSq := 0.0, 0.0
+	for i, fitted := range r.Predicted {
+		e := r.Residuals[i]
+		if r.TargetTransform != nil {
+			e = r.TargetValue(fitted+e) - r.TargetValue(fitted)
+		}
+		sumAbs += math.Abs(e)
+		sumSq += e * e
+	}
+	n := float64(len(r.Predicted))
+	r.MAE, r.RMSE = sumAbs/n, math.Sqrt(sumSq/n)
+}
+
+// Map a fitted value back to the target's original units, undoing any
+// quantile normalization of the target
+func (r RegressionResult) TargetValue(fitted float64) float64 {
+	if r.TargetTransform == nil {
+		return fitted
+	}
+	return r.TargetTransform.Inverse(fitted)
+}
+
+// Map a scaled value of predictor j back to its original units using the
+// fitted scaler
+func (r RegressionResult) Denormalize(j int, scaled float64) (float64, error) {
+	if r.Scaler == nil {
+		return 0, fmt.Errorf("the model has no fitted scaler")
+	}
+	if j < 0 || j >= len(r.Scaler.Center) {
+		return 0, fmt.Errorf("predictor %d out of range (model has %d)", j, len(r.Scaler.Center))
+	}
+	return r.Scaler.Inverse(j, scaled), nil
+}
+
+// Check that y and x are non-empty, aligned and x is rectangular, and that
+// any weights are positive with one per row
+func checkRegressionInput(y []float64, x [][]float64, weights []float64) error {
+	if len(y) != len(x) {
+		return fmt.Errorf("target and predictors are misaligned: %d target values but %d predictor rows", len(y), len(x))
+	}
+	if len(x) == 0 || len(y) == 0 || len(x[0]) == 0 {
+		return fmt.Errorf("insufficient data for regression analysis")
+	}
+	k := len(x[0])
+	for i, row := range x {
+		if len(row) != k {
+			return fmt.Errorf("predictor row %d has %d values, expected %d", i, len(row), k)
+		}
+	}
+	if weights == nil {
+		return nil
+	}
+	if len(weights) != len(y) {
+		return fmt.Errorf("got %d weights for %d rows", len(weights), len(y))
+	}
+	for i, w := range weights {
+		if !(w > 0) || math.IsInf(w, 0) {
+			return fmt.Errorf("weight %d is %g, weights must be positive and finite", i, w)
+		}
+	}
+	return nil
+}
+
+// Fit on a random training portion of the data and report R-squared on the
+// held-out rest. testFrac is the fraction held out. The scaler is fitted on
+// the training rows only and then applied unchanged to the test rows, so
+// nothing about the test set leaks into the fit.
+func runRegressionHoldout(y []float64, x [][]float64, weights []float64, scaling string, testFrac float64, seed int64) (RegressionResult, error) {
+	if !(testFrac > 0 && testFrac < 1) {
+		return RegressionResult{}, fmt.Errorf("test fraction must be between 0 and 1, got %g", testFrac)
+	}
+	if err := checkRegressionInput(y, x, weights); err != nil {
+		return RegressionResult{}, err
+	}
+	train, test := splitIndexes(len(y), testFrac, seed)
+	if len(test) == 0 || len(train) == 0 {
+		return RegressionResult{}, fmt.Errorf("test fraction %g leaves an empty split of %d rows", testFrac, len(y))
+	}
+	// A single test row has no variance to score R-squared against
+	if len(test) < 2 {
+		return RegressionResult{}, fmt.Errorf("test fraction %g holds out %d of %d rows, but test R-squared needs at least 2", testFrac, len(test), len(y))
+	}
+	result, testRSquared, err := fitAndScore(y, x, weights, scaling, train, test)
+	if err != nil {
+		return RegressionResult{}, err
+	}
+	result.setRanges(y, x)
+	result.TestN = len(test)
+	result.TestRSquared = testRSquared
+	return result, nil
+}
+
+// Fit on the train rows and return the model with its R-squared on the test
+// rows. The scaler is fitted on the train rows only.
+func fitAndScore(y []float64, x [][]float64, weights []float64, scaling string, train, test []int) (RegressionResult, float64, error) {
+	yTrain, xTrain, wTrain := selectRows(y, x, weights, train)
+	yTest, xTest, wTest := selectRows(y, x, weights, test)
+
+	scaler, xTrain, err := fitTransform(scaling, xTrain)
+	if err != nil {
+		return RegressionResult{}, 0, err
+	}
+	xTest, err = scaler.Transform(xTest)
+	if err != nil {
+		return RegressionResult{}, 0, err
+	}
+	result, err := fitRegression(yTrain, xTrain, wTrain, scaling)
+	if err != nil {
+		return RegressionResult{}, 0, err
+	}
+	result.Scaler = scaler
+
+	// Score the held-out rows against their own (weighted) mean
+	yMean := stat.Mean(yTest, wTest)
+	ssTotal, ssResidual := 0.0, 0.0
+	for i, row := range xTest {
+		w := 1.0
+		if wTest != nil {
+			w = wTest[i]
+		}
+		residual := yTest[i] - result.predictScaled(row)
+		ssTotal += w * (yTest[i] - yMean) * (yTest[i] - yMean)
+		ssResidual += w * residual * residual
+	}
+	return result, 1 - (ssResidual / ssTotal), nil
+}
+
+// K-fold cross-validation: shuffle the rows with a seeded source, deal them
+// into folds, and for each fold fit on the others and score R-squared on
+// it. Returns one out-of-sample R-squared per fold.
+func crossValidate(y []float64, x [][]float64, weights []float64, scaling string, folds int, seed int64) ([]float64, error) {
+	if err := checkRegressionInput(y, x, weights); err != nil {
+		return nil, err
+	}
+	// A fold of one row has no variance to score R-squared against
+	if folds < 2 || folds > len(y)/2 {
+		return nil, fmt.Errorf("need between 2 and %d folds for %d rows so that every fold holds at least 2, got %d", len(y)/2, len(y), folds)
+	}
+
+	perm := rand.New(rand.NewSource(seed)).Perm(len(y))
+	scores := make([]float64, folds)
+	for f := range scores {
+		var train, test []int
+		for i, idx := range perm {
+			if i%folds == f {
+				test = append(test, idx)
+			} else {
+				train = append(train, idx)
+			}
+		}
+		_, r2, err := fitAndScore(y, x, weights, scaling, train, test)
+		if err != nil {
+			return nil, fmt.Errorf("error in fold %d: %w", f+1, err)
+		}
+		scores[f] = r2
+	}
+	return scores, nil
+}
+
+// Randomly split rows into a training set and a test set holding
+// round(frac*n) rows. The same seed always gives the same split.
+func trainTestSplit(y []float64, x [][]float64, frac float64, seed int64) ([]float64, [][]float64, []float64, [][]float64) {
+	train, test := splitIndexes(len(y), frac, seed)
+	yTrain, xTrain, _ := selectRows(y, x, nil, train)
+	yTest, xTest, _ := selectRows(y, x, nil, test)
+	return yTrain, xTrain, yTest, xTest
+}
+
+// Return the header (row 0) and a random round(frac*n) of the other rows,
+// in their original order. The same seed always picks the same rows.
+func sampleRows(rows [][]string, frac float64, seed int64) [][]string {
+	if len(rows) == 0 {
+		return rows
+	}
+	data := rows[1:]
+	n := int(math.Round(frac * float64(len(data))))
+	if n < 0 {
+		n = 0
+	} else if n > len(data) {
+		n = len(data)
+	}
+	picked := rand.New(rand.NewSource(seed)).Perm(len(data))[:n]
+	sort.Ints(picked)
+
+	result := [][]string{rows[0]}
+	for _, i := range picked {
+		result = append(result, data[i])
+	}
+	return result
+}
+
+// Shuffle the row indexes 0..n-1 with a seeded source and split off
+// round(frac*n) of them as the test set
+func splitIndexes(n int, frac float64, seed int64) ([]int, []int) {
+	perm := rand.New(rand.NewSource(seed)).Perm(n)
+	nTest := int(math.Round(frac * float64(n)))
+	if nTest < 0 {
+		nTest = 0
+	} else if nTest > n {
+		nTest = n
+	}
+	return perm[nTest:], perm[:nTest]
+}
+
+// Pick the given rows out of y, x and (when non-nil) weights
+func selectRows(y []float64, x [][]float64, weights []float64, rows []int) ([]float64, [][]float64, []float64) {
+	ySel := make([]float64, len(rows))
+	xSel := make([][]float64, len(rows))
+	var wSel []float64
+	if weights != nil {
+		wSel = make([]float64, len(rows))
+	}
+	for i, idx := range rows {
+		ySel[i], xSel[i] = y[idx], x[idx]
+		if weights != nil {
+			wSel[i] = weights[idx]
+		}
+	}
+	return ySel, xSel, wSel
+}
+
+// Predict from a row of predictors already on the fitted scale
+func (r RegressionResult) predictScaled(row []float64) float64 {
+	predicted := r.Intercept
+	for j, val := range row {
+		predicted += r.Coefficients[j] * val
+	}
+	return predicted
+}
+
+// Fit least squares on already-scaled predictors. Weighted fits scale each
+// row of the design and target by the square root of its weight.
+func fitRegression(y []float64, xNorm [][]float64, weights []float64, scaling string) (RegressionResult, error) {
+	k := len(xNorm[0])
+
+	// Build the design matrix with a leading intercept column
+	n := len(y)
+	design := mat.NewDense(n, k+1, nil)
+	target := mat.NewVecDense(n, nil)
+	for i, row := range xNorm {
+		sw := 1.0
+		if weights != nil {
+			sw = math.Sqrt(weights[i])
+		}
+		design.Set(i, 0, sw)
+		for j, val := range row {
+			design.Set(i, j+1, sw*val)
+		}
+		target.SetVec(i, sw*y[i])
+	}
+
+	// Compute regression coefficients by least squares
+	var coef mat.VecDense
+	if err := coef.SolveVec(design, target); err != nil {
+		return RegressionResult{}, fmt.Errorf("error solving regression: %w", err)
+	}
+	result := RegressionResult{
+		Intercept:    coef.AtVec(0),
+		Coefficients: make([]float64, k),
+		N:            n,
+		Scaling:      scaling,
+		Weights:      weights,
+	}
+	for j := range result.Coefficients {
+		result.Coefficients[j] = coef.AtVec(j + 1)
+	}
+
+	// Compute predictions, residuals and (weighted) R-squared
+	yMean := stat.Mean(y, weights)
+	ssTotal, ssResidual := 0.0, 0.0
+	result.Predicted = make([]float64, n)
+	result.Residuals = make([]float64, n)
+	for i := range y {
+		w := 1.0
+		if weights != nil {
+			w = weights[i]
+		}
+		predicted := result.predictScaled(xNorm[i])
+		result.Predicted[i] = predicted
+		result.Residuals[i] = y[i] - predicted
+		ssTotal += w * (y[i] - yMean) * (y[i] - yMean)
+		ssResidual += w * result.Residuals[i] * result.Residuals[i]
+	}
+	result.RSquared = 1 - (ssResidual / ssTotal)
+	result.Spearman = spearman(y, result.Predicted)
+	result.setErrors()
+
+	// Compute adjusted R-squared = 1 - (1-R²)(n-1)/(n-k-1)
+	result.AdjRSquared = math.NaN()
+	if n-k-1 > 0 {
+		result.AdjRSquared = 1 - (1-result.RSquared)*float64(n-1)/float64(n-k-1)
+	}
+
+	// Compute the overall F-statistic = (SSexplained/k) / (SSresidual/(n-k-1))
+	result.FStatistic, result.FPValue = math.NaN(), math.NaN()
+	if n-k-1 > 0 {
+		result.FStatistic = ((ssTotal - ssResidual) / float64(k)) / (ssResidual / float64(n-k-1))
+		fDist := distuv.F{D1: float64(k), D2: float64(n - k - 1)}
+		result.FPValue = fDist.Survival(result.FStatistic)
+	}
+
+	// Compute standard errors, t-statistics and p-values
+	stdErrs, tStats, pValues, xtxInv, err := coefficientStats(design, &coef, ssResidual)
 	if err != nil {
-		log.Fatalf("Error opening CSV file: %v", err)
+		return RegressionResult{}, err
+	}
+	result.InterceptStdError, result.InterceptTStat, result.InterceptPValue = stdErrs[0], tStats[0], pValues[0]
+	result.StdErrors, result.TStats, result.PValues = stdErrs[1:], tStats[1:], pValues[1:]
+	result.xtxInv = xtxInv
+	result.residualDF = n - (k + 1)
+	if result.residualDF > 0 {
+		result.residualVariance = ssResidual / float64(result.residualDF)
+	}
+	return result, nil
+}
+
+// Predict the target for new rows of predictors in their original units:
+// each row is scaled with the stored Scaler, the coefficients applied and
+// any quantile normalization of the target undone. Rows with the wrong
+// number of values predict NaN.
+func (r RegressionResult) Predict(x [][]float64) []float64 {
+	predictions := make([]float64, len(x))
+	for i, row := range x {
+		if len(row) != len(r.Coefficients) {
+			predictions[i] = math.NaN()
+			continue
+		}
+		if r.Scaler != nil {
+			scaled, err := r.Scaler.Transform([][]float64{row})
+			if err != nil {
+				predictions[i] = math.NaN()
+				continue
+			}
+			row = scaled[0]
+		}
+		predictions[i] = r.TargetValue(r.predictScaled(row))
+	}
+	return predictions
+}
+
+// Confidence level of the intervals from PredictionInterval
+const predictionLevel = 0.95
+
+// Predict y for a vector of predictors in their original units, like
+// Predict, and return the 95% prediction interval for a new observation:
+//
+//	ŷ ± t(n-k-1) · s · sqrt(1 + x'(X'X)^-1 x)
+//
+// where x is scaled with the stored Scaler, includes the intercept term, and
+// s is the residual standard error. The prediction and both bounds are
+// mapped back through any quantile normalization of the target. This
+// assumes the linear model is correct and the residuals are independent and
+// normally distributed with constant variance. For weighted fits the
+// interval is for an observation of weight 1.
+func (r RegressionResult) PredictionInterval(x []float64) (predicted, lower, upper float64, err error) {
+	if len(x) != len(r.Coefficients) {
+		return 0, 0, 0, fmt.Errorf("got %d predictor values, the model has %d", len(x), len(r.Coefficients))
+	}
+	if r.xtxInv == nil {
+		return 0, 0, 0, fmt.Errorf("prediction intervals need more observations than coefficients (n=%d, k=%d)", r.N, len(r.Coefficients))
+	}
+	if r.Scaler != nil {
+		scaled, err := r.Scaler.Transform([][]float64{x})
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("error scaling predictors: %w", err)
+		}
+		x = scaled[0]
+	}
+
+	// Leverage of x against the fitted design
+	point := mat.NewVecDense(len(x)+1, append([]float64{1}, x...))
+	leverage := mat.Inner(point, r.xtxInv, point)
+
+	predicted = r.predictScaled(x)
+	tDist := distuv.StudentsT{Mu: 0, Sigma: 1, Nu: float64(r.residualDF)}
+	margin := tDist.Quantile(1-(1-predictionLevel)/2) * math.Sqrt(r.residualVariance*(1+leverage))
+	return r.TargetValue(predicted), r.TargetValue(predicted - margin), r.TargetValue(predicted + margin), nil
+}
+
+// Compute the standard error, t-statistic and two-sided p-value of each
+// coefficient (intercept first) from the residual variance and (X'X)^-1,
+// which is also returned (nil when there are no residual degrees of freedom)
+func coefficientStats(design *mat.Dense, coef *mat.VecDense, ssResidual float64) ([]float64, []float64, []float64, *mat.Dense, error) {
+	n, p := design.Dims()
+	stdErrs := make([]float64, p)
+	tStats := make([]float64, p)
+	pValues := make([]float64, p)
+
+	df := n - p
+	if df <= 0 {
+		for j := 0; j < p; j++ {
+			stdErrs[j], tStats[j], pValues[j] = math.NaN(), math.NaN(), math.NaN()
+		}
+		return stdErrs, tStats, pValues, nil, nil
+	}
+
+	var xtx, xtxInv mat.Dense
+	xtx.Mul(design.T(), design)
+	if err := xtxInv.Inverse(&xtx); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("error inverting X'X for standard errors: %w", err)
+	}
+
+	sigma2 := ssResidual / float64(df)
+	tDist := distuv.StudentsT{Mu: 0, Sigma: 1, Nu: float64(df)}
+	for j := 0; j < p; j++ {
+		stdErrs[j] = math.Sqrt(sigma2 * xtxInv.At(j, j))
+		tStats[j] = coef.AtVec(j) / stdErrs[j]
+		pValues[j] = 2 * tDist.Survival(math.Abs(tStats[j]))
+	}
+	return stdErrs, tStats, pValues, &xtxInv, nil
+}
+
+// Name of predictor j, falling back to x1, x2, ... when names are not set
+func (r RegressionResult) predictorName(j int) string {
+	if j < len(r.Predictors) && r.Predictors[j] != "" {
+		return r.Predictors[j]
 	}
-	defer file.Close()
+	return fmt.Sprintf("x%d", j+1)
+}
 
-	reader := csv.NewReader(file)
-	data, err := reader.ReadAll()
-	if err != nil {
-		log.Fatalf("Error reading CSV file: %v", err)
+// Convert a float for JSON output, mapping NaN and Inf to null
+func jsonFloat(v float64) *float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
 	}
-	return data
+	return &v
 }
 
-// Load Excel file
-func loadExcel(filename string) [][]string {
-	f, err := excelize.OpenFile(filename)
-	if err != nil {
-		log.Fatalf("Error opening Excel file: %v", err)
+// WriteJSON serializes the fitted model and its metadata as JSON
+func (r RegressionResult) WriteJSON(w io.Writer) error {
+	payload := struct {
+		Intercept       *float64   `json:"intercept"`
+		Coefficients    []*float64 `json:"coefficients"`
+		Predictors      []string   `json:"predictors"`
+		RSquared        *float64   `json:"r_squared"`
+		AdjRSquared     *float64   `json:"adjusted_r_squared"`
+		Spearman        *float64   `json:"spearman"`
+		MAE             *float64   `json:"mae"`
+		RMSE            *float64   `json:"rmse"`
+		FStatistic      *float64   `json:"f_statistic"`
+		FPValue         *float64   `json:"f_p_value"`
+		N               int        `json:"n"`
+		Normalization   string     `json:"normalization"`
+		Weighted        bool       `json:"weighted,omitempty"`
+		Huber           bool       `json:"huber,omitempty"`
+		TargetMin       *float64   `json:"target_min"`
+		TargetMax       *float64   `json:"target_max"`
+		PredictorMin    []*float64 `json:"predictor_min"`
+		PredictorMax    []*float64 `json:"predictor_max"`
+		TestN           int        `json:"test_n,omitempty"`
+		TestRSquared    *float64   `json:"test_r_squared,omitempty"`
+		CVFolds         int        `json:"cv_folds,omitempty"`
+		CVRSquaredMean  *float64   `json:"cv_r_squared_mean,omitempty"`
+		CVRSquaredSD    *float64   `json:"cv_r_squared_sd,omitempty"`
+		TargetTransform string     `json:"target_transform,omitempty"`
+	}{
+		Intercept:     jsonFloat(r.Intercept),
+		Coefficients:  make([]*float64, len(r.Coefficients)),
+		Predictors:    make([]string, len(r.Coefficients)),
+		RSquared:      jsonFloat(r.RSquared),
+		AdjRSquared:   jsonFloat(r.AdjRSquared),
+		Spearman:      jsonFloat(r.Spearman),
+		MAE:           jsonFloat(r.MAE),
+		RMSE:          jsonFloat(r.RMSE),
+		FStatistic:    jsonFloat(r.FStatistic),
+		FPValue:       jsonFloat(r.FPValue),
+		N:             r.N,
+		Normalization: r.Scaling,
+		Weighted:      r.Weights != nil,
+		Huber:         r.Huber,
+		TargetMin:     jsonFloat(r.TargetMin),
+		TargetMax:     jsonFloat(r.TargetMax),
+	}
+	for j := range r.PredictorMin {
+		payload.PredictorMin = append(payload.PredictorMin, jsonFloat(r.PredictorMin[j]))
+		payload.PredictorMax = append(payload.PredictorMax, jsonFloat(r.PredictorMax[j]))
+	}
+	if r.TestN > 0 {
+		payload.TestN = r.TestN
+		payload.TestRSquared = jsonFloat(r.TestRSquared)
+	}
+	if r.CVFolds > 0 {
+		payload.CVFolds = r.CVFolds
+		payload.CVRSquaredMean = jsonFloat(r.CVRSquaredMean)
+		payload.CVRSquaredSD = jsonFloat(r.CVRSquaredStdDev)
+	}
+	if r.TargetTransform != nil {
+		payload.TargetTransform = "quantile-normal"
+	}
+	for j, c := range r.Coefficients {
+		payload.Coefficients[j] = jsonFloat(c)
+		payload.Predictors[j] = r.predictorName(j)
 	}
 
-	// Print available sheet names
-	sheets := f.GetSheetList()
-	fmt.Println("Available Sheets in Excel:", sheets)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(payload)
+}
 
-	// Use the first sheet automatically
-	if len(sheets) == 0 {
-		log.Fatalf("No sheets found in the Excel file")
+// Write the model as a CSV header and a single summary row: scaling, n,
+// R-squared, adjusted R-squared, the F-test, intercept and one column per
+// predictor.
+// Undefined (NaN) statistics are written as empty cells.
+func (r RegressionResult) WriteCSVSummary(w io.Writer) error {
+	cell := func(v float64) string {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return ""
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	header := []string{"normalization", "n", "r_squared", "adjusted_r_squared", "f_statistic", "f_p_value", "intercept"}
+	row := []string{r.Scaling, strconv.Itoa(r.N), cell(r.RSquared), cell(r.AdjRSquared), cell(r.FStatistic), cell(r.FPValue), cell(r.Intercept)}
+	for j, c := range r.Coefficients {
+		header = append(header, r.predictorName(j))
+		row = append(row, cell(c))
+	}
+	header = append(header, "mae", "rmse")
+	row = append(row, cell(r.MAE), cell(r.RMSE))
+	if r.TestN > 0 {
+		header = append(header, "test_n", "test_r_squared")
+		row = append(row, strconv.Itoa(r.TestN), cell(r.TestRSquared))
+	}
+	if r.CVFolds > 0 {
+		header = append(header, "cv_folds", "cv_r_squared_mean", "cv_r_squared_sd")
+		row = append(row, strconv.Itoa(r.CVFolds), cell(r.CVRSquaredMean), cell(r.CVRSquaredStdDev))
 	}
-	sheet := sheets[0]
-	fmt.Println("Using Sheet:", sheet)
 
-	// Read the sheet data
-	rows, err := f.GetRows(sheet)
-	if err != nil {
-		log.Fatalf("Error reading Excel sheet: %v", err)
+	writer := csv.NewWriter(w)
+	writer.Write(header)
+	writer.Write(row)
+	writer.Flush()
+	return writer.Error()
+}
+
+// Ranks of the values (1 for the smallest), giving tied values the average
+// of the ranks they span
+func ranks(v []float64) []float64 {
+	order := make([]int, len(v))
+	for i := range order {
+		order[i] = i
 	}
-	return rows
+	sort.SliceStable(order, func(a, b int) bool { return v[order[a]] < v[order[b]] })
+
+	r := make([]float64, len(v))
+	for start := 0; start < len(order); {
+		end := start + 1
+		for end < len(order) && v[order[end]] == v[order[start]] {
+			end++
+		}
+		avg := float64(start+end+1) / 2 // Mean of the 1-based ranks start+1..end
+		for _, i := range order[start:end] {
+			r[i] = avg
+		}
+		start = end
+	}
+	return r
 }
 
-// Function to filter Algeria data
-func filterAlgeria(data [][]string, countryCol int) [][]string {
-	var result [][]string
-	for _, row := range data {
-		if len(row) > countryCol && strings.EqualFold(row[countryCol], "Algeria") {
-			result = append(result, row)
+// Spearman rank correlation: the Pearson correlation of the ranks, so it
+// measures any monotonic association rather than only a linear one. NaN when
+// the lengths differ, there are fewer than two values or either is constant.
+func spearman(a, b []float64) float64 {
+	if len(a) != len(b) || len(a) < 2 {
+		return math.NaN()
+	}
+	ra, rb := ranks(a), ranks(b)
+	if !(stat.StdDev(ra, nil) > 0) || !(stat.StdDev(rb, nil) > 0) {
+		return math.NaN()
+	}
+	return stat.Correlation(ra, rb, nil)
+}
+
+// Pearson correlation between every pair of predictor columns of a
+// rectangular matrix. Correlations involving a constant column are
+// undefined and reported as NaN, including on the diagonal.
+func correlationMatrix(x [][]float64) [][]float64 {
+	if len(x) == 0 {
+		return nil
+	}
+	k := len(x[0])
+	columns := make([][]float64, k)
+	constant := make([]bool, k)
+	for j := range columns {
+		columns[j] = column(x, j)
+		constant[j] = !(stat.StdDev(columns[j], nil) > 0)
+	}
+
+	corr := make([][]float64, k)
+	for i := range corr {
+		corr[i] = make([]float64, k)
+		for j := range corr[i] {
+			switch {
+			case constant[i] || constant[j]:
+				corr[i][j] = math.NaN()
+			case i == j:
+				corr[i][j] = 1
+			default:
+				corr[i][j] = stat.Correlation(columns[i], columns[j], nil)
+			}
 		}
 	}
-	return result
+	return corr
 }
 
-// Haversine formula to calculate distance (in km)
-func haversine(lat1, lon1, lat2, lon2 float64) float64 {
-	const R = 6371 // Earth's radius in km
-	dLat := (lat2 - lat1) * (math.Pi / 180.0)
-	dLon := (lon2 - lon1) * (math.Pi / 180.0)
+// Variance inflation factor of each predictor column: 1/(1-R²) of the
+// regression of that column on all the others plus an intercept. Columns
+// that are perfectly collinear with the others (or constant) get +Inf.
+func vif(x [][]float64) []float64 {
+	if len(x) == 0 {
+		return nil
+	}
+	n, k := len(x), len(x[0])
+	factors := make([]float64, k)
+	for j := 0; j < k; j++ {
+		target := column(x, j)
+		design := mat.NewDense(n, k, nil)
+		for i, row := range x {
+			design.Set(i, 0, 1)
+			c := 1
+			for m, val := range row {
+				if m != j {
+					design.Set(i, c, val)
+					c++
+				}
+			}
+		}
 
-	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*(math.Pi/180.0))*math.Cos(lat2*(math.Pi/180.0))*math.Sin(dLon/2)*math.Sin(dLon/2)
-	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
-	return R * c
+		var coef, fitted mat.VecDense
+		if err := coef.SolveVec(design, mat.NewVecDense(n, target)); err != nil {
+			factors[j] = math.Inf(1)
+			continue
+		}
+		fitted.MulVec(design, &coef)
+		mean := stat.Mean(target, nil)
+		ssTotal, ssResidual := 0.0, 0.0
+		for i, val := range target {
+			ssTotal += (val - mean) * (val - mean)
+			ssResidual += (val - fitted.AtVec(i)) * (val - fitted.AtVec(i))
+		}
+		// Treat a residual at rounding level as an exact fit
+		if ssTotal == 0 || ssResidual <= 1e-12*ssTotal {
+			factors[j] = math.Inf(1)
+			continue
+		}
+		factors[j] = ssTotal / ssResidual // 1/(1-R²)
+	}
+	return factors
 }
 
-// Convert string to float safely
-func parseFloat(s string) float64 {
-	val, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
-	if err != nil {
-		return 0.0
+// Print the variance inflation factor of each predictor, flagging values
+// above 10 as a sign of multicollinearity
+func printVIF(factors []float64, result RegressionResult) {
+	fmt.Println("\nVariance Inflation Factors:")
+	for j, v := range factors {
+		note := ""
+		if v > 10 {
+			note = "  (high: consider dropping)"
+		}
+		fmt.Printf("%-12s %12.4f%s\n", result.predictorName(j), v, note)
 	}
-	return val
 }
 
-func SaveDanglingRecords(filename string, data [][]string) {
-	file, err := os.Create(filename)
-	if err != nil {
-		log.Fatalf("Error Creating file: %v", err)
+// Print a correlation matrix with predictor labels
+func printCorrelationMatrix(corr [][]float64, result RegressionResult) {
+	fmt.Println("\nPredictor Correlation Matrix:")
+	fmt.Printf("%-12s", "")
+	for j := range corr {
+		fmt.Printf(" %12s", result.predictorName(j))
 	}
-	defer file.Close()
+	fmt.Println()
+	for i, row := range corr {
+		fmt.Printf("%-12s", result.predictorName(i))
+		for _, c := range row {
+			fmt.Printf(" %12.4f", c)
+		}
+		fmt.Println()
+	}
+}
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+// Print a regression result in human-readable form
+func printRegressionResult(result RegressionResult) {
+	model := fmt.Sprintf("%.4f", result.Intercept)
+	for j, c := range result.Coefficients {
+		model += fmt.Sprintf(" + %.4f * %s", c, result.predictorName(j))
+	}
+	fmt.Printf("\nRegression Model (Normalized): Flaring Volume = %s\n", model)
+	fmt.Printf("%-10s %12s %12s %10s %10s\n", "Term", "Estimate", "Std. Error", "t", "p-value")
+	fmt.Printf("%-10s %12.4f %12.4f %10.4f %10.4f\n", "intercept", result.Intercept, result.InterceptStdError, result.InterceptTStat, result.InterceptPValue)
+	for j, c := range result.Coefficients {
+		fmt.Printf("%-10s %12.4f %12.4f %10.4f %10.4f\n", result.predictorName(j), c, result.StdErrors[j], result.TStats[j], result.PValues[j])
+	}
+	fmt.Printf("R-squared (Normalized): %.4f\n", result.RSquared)
+	fmt.Printf("Adjusted R-squared: %.4f\n", result.AdjRSquared)
+	fmt.Printf("MAE: %.4f, RMSE: %.4f (target units)\n", result.MAE, result.RMSE)
+	fmt.Printf("Spearman rank correlation (target vs fitted): %.4f\n", result.Spearman)
+	if result.Spearman*result.Spearman > result.RSquared+0.05 {
+		fmt.Println("  The rank correlation is notably stronger than the linear fit; a monotonic transform of the target or predictors may help")
+	}
+	fmt.Printf("F-statistic: %.4f on %d and %d DF, p-value: %.4g\n", result.FStatistic, len(result.Coefficients), result.residualDF, result.FPValue)
+	fmt.Printf("Observations: %d\n", result.N)
+	switch {
+	case result.Huber:
+		fmt.Printf("Fit: Huber robust regression, %d reweighting iterations\n", result.HuberIterations)
+	case result.Weights != nil:
+		fmt.Println("Fit: weighted least squares")
+	}
+	if result.TestN > 0 {
+		fmt.Printf("Test R-squared (Normalized): %.4f on %d held-out observations\n", result.TestRSquared, result.TestN)
+	}
+	if result.CVFolds > 0 {
+		fmt.Printf("Cross-validated R-squared (Normalized): %.4f ± %.4f over %d folds\n", result.CVRSquaredMean, result.CVRSquaredStdDev, result.CVFolds)
+	}
+	if result.TargetTransform != nil {
+		fmt.Println("Target: quantile-normalized; coefficients describe its normal scores, not the original units")
+	}
 
-	for _, record := range data {
-		_ = writer.Write(record)
+	fmt.Println("Ranges before scaling:")
+	fmt.Printf("%-10s %12.4f %12.4f\n", "target", result.TargetMin, result.TargetMax)
+	for j := range result.PredictorMin {
+		fmt.Printf("%-10s %12.4f %12.4f\n", result.predictorName(j), result.PredictorMin[j], result.PredictorMax[j])
 	}
 }
 
-// Join datasets within 3km clustering
-func joinDatasets(csvData, excelData [][]string, csvLatCol, csvLonCol, excelLatCol, excelLonCol int) ([][]string, [][]string) {
-	var joined [][]string
-	var dangling [][]string
+// RunSummary collects the counts and results of one run for writeReport
+type RunSummary struct {
+	CSVFile, ExcelFile         string
+	CSVRows, ExcelRows         int // Data rows loaded
+	CSVFiltered, ExcelFiltered int // Data rows left after the country filter
+	Joined, Dangling           int
+	Regression                 *RegressionResult // nil when no regression was run
+}
+
+// Write a Markdown report of a run: rows loaded and filtered per file, the
+// join outcome and the regression result
+func writeReport(filename string, s RunSummary) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Flaring regression report\n\n")
 
-	for _, csvRow := range csvData[1:] {
-		csvLat, csvLon := parseFloat(csvRow[csvLatCol]), parseFloat(csvRow[csvLonCol])
-		closestDist := 3.0
-		var bestMatch []string
+	fmt.Fprintf(&b, "## Data\n\n")
+	fmt.Fprintf(&b, "| File | Rows loaded | Rows after filtering |\n|---|---:|---:|\n")
+	fmt.Fprintf(&b, "| CSV `%s` | %d | %d |\n", s.CSVFile, s.CSVRows, s.CSVFiltered)
+	fmt.Fprintf(&b, "| Excel `%s` | %d | %d |\n\n", s.ExcelFile, s.ExcelRows, s.ExcelFiltered)
 
-		for _, excelRow := range excelData[1:] {
-			excelLat, excelLon := parseFloat(excelRow[excelLatCol]), parseFloat(excelRow[excelLonCol])
-			distance := haversine(csvLat, csvLon, excelLat, excelLon)
-			if distance < closestDist {
-				closestDist = distance
-				bestMatch = excelRow
-			}
+	fmt.Fprintf(&b, "## Join\n\n")
+	fmt.Fprintf(&b, "- Joined: %d\n", s.Joined)
+	ratio := 0.0
+	if total := s.Joined + s.Dangling; total > 0 {
+		ratio = float64(s.Dangling) / float64(total)
+	}
+	fmt.Fprintf(&b, "- Dangling: %d (%.1f%%)\n\n", s.Dangling, 100*ratio)
+
+	if r := s.Regression; r != nil {
+		fmt.Fprintf(&b, "## Regression\n\n")
+		fmt.Fprintf(&b, "| Term | Estimate | Std. Error | t | p-value |\n|---|---:|---:|---:|---:|\n")
+		fmt.Fprintf(&b, "| intercept | %.4f | %.4f | %.4f | %.4f |\n", r.Intercept, r.InterceptStdError, r.InterceptTStat, r.InterceptPValue)
+		for j, c := range r.Coefficients {
+			fmt.Fprintf(&b, "| %s | %.4f | %.4f | %.4f | %.4f |\n", r.predictorName(j), c, r.StdErrors[j], r.TStats[j], r.PValues[j])
 		}
+		fmt.Fprintf(&b, "\n- Normalization: %s\n", r.Scaling)
+		fmt.Fprintf(&b, "- Observations: %d\n", r.N)
+		fmt.Fprintf(&b, "- R-squared: %.4f (adjusted %.4f)\n", r.RSquared, r.AdjRSquared)
+		fmt.Fprintf(&b, "- F-statistic: %.4f, p-value %.4g\n", r.FStatistic, r.FPValue)
+		fmt.Fprintf(&b, "- MAE: %.4f, RMSE: %.4f\n", r.MAE, r.RMSE)
+		if r.TestN > 0 {
+			fmt.Fprintf(&b, "- Test R-squared: %.4f on %d held-out observations\n", r.TestRSquared, r.TestN)
+		}
+	}
 
-		if bestMatch != nil {
-			joinedRow := append(csvRow, bestMatch...)
-			joined = append(joined, joinedRow)
-		} else {
-			dangling = append(dangling, csvRow)
+	if err := os.WriteFile(filename, []byte(b.String()), 0o644); err != nil {
+		return fmt.Errorf("error writing report: %w", err)
+	}
+	return nil
+}
+
+// Count data rows whose latitude lies outside [-90, 90] and whose longitude
+// lies outside [-180, 180]. Unparseable coordinates are not counted.
+func coordinateRangeErrors(data [][]string, latCol, lonCol int) (badLat, badLon int) {
+	for _, row := range data[1:] {
+		if len(row) <= latCol || len(row) <= lonCol {
+			continue
 		}
+		lat, lon, ok := parseLatLon(row, latCol, lonCol)
+		if !ok {
+			continue
+		}
+		if lat < -90 || lat > 90 {
+			badLat++
+		}
+		if lon < -180 || lon > 180 {
+			badLon++
+		}
+	}
+	return badLat, badLon
+}
+
+// Warn when a dataset's coordinates fall outside the valid ranges, which
+// usually means the lat and lon columns are swapped. Reports whether any
+// were found.
+func warnCoordinateRanges(label string, data [][]string, latCol, lonCol int) bool {
+	badLat, badLon := coordinateRangeErrors(data, latCol, lonCol)
+	if badLat == 0 && badLon == 0 {
+		return false
+	}
+	Logger.Printf("WARNING: %s has %d latitudes outside [-90, 90] and %d longitudes outside [-180, 180] (lat column [%d] %s, lon column [%d] %s).",
+		label, badLat, badLon, latCol, data[0][latCol], lonCol, data[0][lonCol])
+	if badLat > 0 {
+		Logger.Printf("WARNING: The %s lat/lon columns may be swapped; check -%s-lat and -%s-lon.", label, strings.ToLower(label), strings.ToLower(label))
+	}
+	return true
+}
+
+// Set flags from a JSON config file whose keys are flag names, e.g.
+// {"csv": "flares.csv", "csv-lat": "latitude", "radius": 5}. Flags already
+// given on the command line keep their values.
+func applyConfig(fs *flag.FlagSet, filename string) error {
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return fmt.Errorf("error parsing config file %s: %w", filename, err)
 	}
 
-	fmt.Printf("DEBUG: Dangling records count in joinDatasets: %d\n", len(dangling)) // Debug print
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
 
-	return joined, dangling
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %q in config file %s", name, filename)
+		}
+		if given[name] {
+			continue
+		}
+		var value string
+		switch v := values[name].(type) {
+		case string:
+			value = v
+		case float64:
+			value = strconv.FormatFloat(v, 'g', -1, 64)
+		case bool:
+			value = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("setting %q in config file %s must be a string, number or boolean", name, filename)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid setting %q in config file %s: %w", name, filename, err)
+		}
+	}
+	return nil
 }
 
-// Extract regression data
-func extractRegressionData(joinedData [][]string, flaringVolIndex int, independentIndexes []int) ([]float64, [][]float64) {
-	var target []float64
-	var predictors [][]float64
+// ColumnInfo describes what a column's values look like (see inferSchema)
+type ColumnInfo struct {
+	Name      string
+	Type      string  // "numeric", "coordinate", "text" or "empty"
+	Parseable float64 // Fraction of non-blank cells that parse as this type (as numbers for text)
+	Blank     int     // Number of blank cells, including cells missing from short rows
+}
 
-	for _, row := range joinedData {
-		if len(row) > flaringVolIndex {
-			y := parseFloat(row[flaringVolIndex])
-			target = append(target, y)
+// Share of parseable values above which a column counts as numeric
+const numericThreshold = 0.9
 
-			var x []float64
-			for _, idx := range independentIndexes {
-				if len(row) > idx {
-					x = append(x, parseFloat(row[idx]))
+// Infer the type of each column from its header and data rows (data[0] is
+// the header). A column is a coordinate when most values parse as one and
+// either its name looks like latitude or longitude or nearly all values are
+// written in degrees-minutes-seconds; numeric when nearly all non-blank
+// values are numbers; text otherwise.
+func inferSchema(data [][]string) []ColumnInfo {
+	if len(data) == 0 {
+		return nil
+	}
+	schema := make([]ColumnInfo, len(data[0]))
+	for j, name := range data[0] {
+		info := ColumnInfo{Name: name, Type: "empty"}
+		nonBlank, numeric, coordinate, dms := 0, 0, 0, 0
+		for _, row := range data[1:] {
+			if j >= len(row) || isBlank(row[j]) {
+				info.Blank++
+				continue
+			}
+			nonBlank++
+			if _, ok := parseFloatStrict(row[j]); ok {
+				numeric++
+			}
+			if v, err := parseCoordinate(row[j]); err == nil && math.Abs(v) <= 180 {
+				coordinate++
+				if strings.ContainsAny(strings.TrimSpace(row[j]), "°º'′\"″ ") {
+					dms++
 				}
 			}
-			predictors = append(predictors, x)
 		}
+		if nonBlank > 0 {
+			numericFrac := float64(numeric) / float64(nonBlank)
+			coordinateFrac := float64(coordinate) / float64(nonBlank)
+			dmsFrac := float64(dms) / float64(nonBlank)
+			_, isLat := guessColumn([]string{name}, latitudeNames)
+			_, isLon := guessColumn([]string{name}, longitudeNames)
+			switch {
+			case (isLat || isLon || dmsFrac >= numericThreshold) && coordinateFrac >= 0.5:
+				info.Type, info.Parseable = "coordinate", coordinateFrac
+			case numericFrac >= numericThreshold:
+				info.Type, info.Parseable = "numeric", numericFrac
+			default:
+				info.Type, info.Parseable = "text", numericFrac
+			}
+		}
+		schema[j] = info
 	}
-	return target, predictors
+	return schema
 }
 
-// Normalize a slice using Min-Max Scaling
-func normalize(data []float64) []float64 {
-	minVal, maxVal := data[0], data[0]
-	for _, val := range data {
-		if val < minVal {
-			minVal = val
+// Print an inferred schema, one line per column with its index
+func printSchema(label string, schema []ColumnInfo) {
+	fmt.Printf("\n%s schema:\n", label)
+	fmt.Printf("  %-5s %-24s %-10s %10s %6s\n", "Index", "Column", "Type", "Parseable", "Blank")
+	for j, c := range schema {
+		fmt.Printf("  [%3d] %-24s %-10s %9.1f%% %6d\n", j, c.Name, c.Type, 100*c.Parseable, c.Blank)
+	}
+}
+
+// Print a dataset's header with indexes, the resolved columns and a few
+// sample coordinates so column settings can be checked before a long join
+func printValidation(label string, data [][]string, countryCol, latCol, lonCol int) {
+	fmt.Printf("\n%s columns:\n", label)
+	for i, name := range data[0] {
+		fmt.Printf("  [%d] %s\n", i, name)
+	}
+	fmt.Printf("Resolved %s columns: country=[%d] %s, lat=[%d] %s, lon=[%d] %s\n", label,
+		countryCol, data[0][countryCol], latCol, data[0][latCol], lonCol, data[0][lonCol])
+
+	fmt.Printf("Sample %s coordinates:\n", label)
+	for i := 1; i < len(data) && i <= 5; i++ {
+		row := data[i]
+		if len(row) <= countryCol || len(row) <= latCol || len(row) <= lonCol {
+			fmt.Printf("  (row too short: %d columns)\n", len(row))
+			continue
 		}
-		if val > maxVal {
-			maxVal = val
+		_, _, ok := parseLatLon(row, latCol, lonCol)
+		status := "ok"
+		if !ok {
+			status = "UNPARSEABLE"
 		}
+		fmt.Printf("  country=%q lat=%q lon=%q (%s)\n", row[countryCol], row[latCol], row[lonCol], status)
 	}
-	scaled := make([]float64, len(data))
-	for i, val := range data {
-		scaled[i] = (val - minVal) / (maxVal - minVal)
-	}
-	return scaled
 }
 
-// Perform linear regression with normalization
-func runRegression(y []float64, x [][]float64) {
-	if len(x) == 0 || len(y) == 0 || len(x[0]) == 0 {
-		log.Fatalf("Error: Insufficient data for regression analysis")
+func main() {
+	// Command-line flags
+	csvFile := flag.String("csv", "", "path to the flare list CSV file, or - for stdin (required)")
+	excelFile := flag.String("excel", "", "path to the flare volume Excel file (required)")
+	encodingName := flag.String("encoding", "utf-8", "text encoding of the CSV file: utf-8, latin1 or windows-1252")
+	delimiter := flag.String("delimiter", "", "field delimiter for the CSV file (use \"tab\" for tabs; default: from the file extension)")
+	csvHeader := flag.Bool("csv-header", true, "whether the first CSV row is a header")
+	excelHeader := flag.Bool("excel-header", true, "whether the first Excel row is a header")
+	sheet := flag.String("sheet", "", "Excel sheet name to read (default: first sheet)")
+	sheetIndex := flag.Int("sheet-index", 0, "1-based position of the Excel sheet to read, as an alternative to -sheet")
+	allSheets := flag.Bool("all-sheets", false, "read every Excel sheet as one dataset, keeping only the first header (sheets must have the same columns)")
+	country := flag.String("country", "Algeria", "country, or comma-separated countries, to filter both datasets on")
+	bbox := flag.String("bbox", "", "also keep only rows inside this box, as minLat,minLon,maxLat,maxLon (minLon > maxLon crosses the 180th meridian)")
+	csvCountryCol := flag.String("csv-country", "0", "country column name or index in the CSV file")
+	csvLatCol := flag.String("csv-lat", "4", "latitude column name or index in the CSV file (default: guessed from the header, else 4)")
+	csvLonCol := flag.String("csv-lon", "5", "longitude column name or index in the CSV file (default: guessed from the header, else 5)")
+	excelCountryCol := flag.String("excel-country", "0", "country column name or index in the Excel file")
+	excelLatCol := flag.String("excel-lat", "1", "latitude column name or index in the Excel file (default: guessed from the header, else 1)")
+	excelLonCol := flag.String("excel-lon", "2", "longitude column name or index in the Excel file (default: guessed from the header, else 2)")
+	csvKeyCol := flag.String("csv-key", "", "optional CSV key column (e.g. operator) that must equal -excel-key for a match")
+	excelKeyCol := flag.String("excel-key", "", "optional Excel key column that must equal -csv-key for a match")
+	radiusKm := flag.Float64("radius", 3.0, "join radius in km (<= 0 joins to the nearest point at any distance)")
+	distanceName := flag.String("distance", "haversine", "distance function for the join: haversine or vincenty")
+	joinedFile := flag.String("joined", "joined_records.csv", "output file for the joined records (default: joined_records.xlsx with -output-format xlsx)")
+	danglingFile := flag.String("dangling", "dangling_records.csv", "output file for CSV rows with no match (default: dangling_records.xlsx with -output-format xlsx)")
+	joinName := flag.String("join", "inner", "join type: inner, left, full or audit (every CSV row with a matched column)")
+	progress := flag.Int("progress", 0, "print join progress to stderr every N CSV rows (0 disables)")
+	danglingWarn := flag.Float64("dangling-warn", 0.5, "warn on stderr when the fraction of unjoined CSV rows exceeds this")
+	oneToOne := flag.Bool("one-to-one", false, "match each Excel row to at most one CSV row")
+	reportFile := flag.String("report", "", "optional output file for a Markdown summary of the run")
+	jsonFile := flag.String("json", "", "optional output file for the regression results as JSON")
+	scaling := flag.String("scaling", scalingMinMax, "predictor scaling method: minmax, zscore or robust")
+	polyDegree := flag.Int("poly-degree", 1, "fit a polynomial of this degree in the first predictor instead of all predictors")
+	impute := flag.Bool("impute", false, "fill predictor cells missing from short rows with the column mean")
+	blankMissing := flag.Bool("blank-missing", false, "treat blank cells as missing rather than zero: drop rows with a blank target, and blank predictors too unless -impute fills them")
+	testFrac := flag.Float64("test-frac", 0, "hold out this fraction of rows to report out-of-sample R-squared (0 fits on all rows)")
+	seed := flag.Int64("seed", 1, "random seed for every randomized step (-sample, -test-frac and -cv-folds)")
+	testSeed := flag.Int64("test-seed", 0, "random seed for the train/test split and the cross-validation folds (0 uses -seed)")
+	weightHalfKm := flag.Float64("weight-distance", 0, "weight rows by join distance, halving the weight every this many km (0 fits unweighted)")
+	dedupe := flag.Bool("dedupe", false, "drop duplicate CSV rows before filtering")
+	dedupeOn := flag.String("dedupe-on", "", "comma-separated CSV columns (names or indexes) that define a duplicate for -dedupe (default: the whole row)")
+	sample := flag.Float64("sample", 0, "regress on a random fraction (0-1] of the joined records (0 uses all)")
+	sampleSeed := flag.Int64("sample-seed", 0, "random seed for -sample (0 uses -seed)")
+	outputFormat := flag.String("output-format", "text", "regression output on stdout: text, json or csv (other output moves to stderr), or xlsx to write the joined and dangling records as Excel with a text report")
+	limit := flag.Int("limit", 0, "only process the first N CSV data rows (0 or negative: no limit)")
+	listCountries := flag.Bool("countries", false, "print the countries in each file with their row counts, then exit")
+	trim := flag.Bool("trim", false, "trim leading and trailing whitespace from every loaded cell")
+	tieBreak := flag.String("tie-break", "row", "how to pick between equidistant Excel rows: \"row\" (first in the file) or an Excel column name or index (smallest value)")
+	categorical := flag.String("categorical", "", "joined column name or index to add as one-hot encoded predictors")
+	clipLow := flag.Float64("clip-low", 0, "drop rows whose target is below this percentile (0-100)")
+	clipHigh := flag.Float64("clip-high", 100, "drop rows whose target is above this percentile (0-100)")
+	cvFolds := flag.Int("cv-folds", 0, "report the mean and standard deviation of R-squared over this many cross-validation folds (0 disables)")
+	target := flag.String("target", "Flaring Vol (million m3)", "joined column name or index to regress on")
+	predictors := flag.String("predictors", "", "comma-separated joined column names or indexes to use as predictors (default: columns 6, 7 and 8)")
+	robust := flag.Bool("robust", false, "fit a Huber robust regression that downweights rows with large residuals")
+	quantileTarget := flag.Bool("quantile-target", false, "rank-transform the target to a standard normal before the regression (coefficients then describe the transformed target)")
+	candidates := flag.Bool("candidates", false, "print a histogram of how many Excel rows were within the radius of each CSV row")
+	explain := flag.Int("explain", 0, "print the closest Excel row, at any distance, for up to N dangling records")
+	schema := flag.Bool("schema", false, "print the inferred type of every column in both files, then exit")
+	validate := flag.Bool("validate", false, "load inputs, print resolved columns and sample coordinates, then exit before joining")
+	showVersion := flag.Bool("version", false, "print the version and build information, then exit")
+	config := flag.String("config", "", "JSON file of flag settings, keyed by flag name; command-line flags take precedence")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(buildInfo())
+		return
+	}
+
+	if *config != "" {
+		if err := applyConfig(flag.CommandLine, *config); err != nil {
+			Logger.Fatalf("Error: %v", err)
+		}
 	}
 
-	// Normalize x values
-	var xFlat []float64
-	for _, row := range x {
-		xFlat = append(xFlat, row[0])
+	if *csvFile == "" || *excelFile == "" {
+		fmt.Fprintln(os.Stderr, "Error: both -csv and -excel are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	distance, err := distanceFuncFor(*distanceName)
+	if err != nil {
+		Logger.Fatalf("Error: %v", err)
+	}
+	joinType, err := joinTypeFor(*joinName)
+	if err != nil {
+		Logger.Fatalf("Error: %v", err)
+	}
+	comma, err := parseDelimiter(*delimiter)
+	if err != nil {
+		Logger.Fatalf("Error: %v", err)
+	}
+	csvEncoding, err := encodingFor(*encodingName)
+	if err != nil {
+		Logger.Fatalf("Error: %v", err)
 	}
-	xFlat = normalize(xFlat)
 
-	// Print normalized values for debugging
-	fmt.Println("\nSample Normalized Data (First 10 values):")
-	for i := 0; i < len(y) && i < 10; i++ {
-		fmt.Printf("y[%d] (Flaring Volume 2019): %.4f, x[%d] (Normalized Predictor): %.4f\n", i, y[i], i, xFlat[i])
+	if *sample < 0 || *sample > 1 {
+		Logger.Fatalf("Error: -sample must be between 0 and 1, got %g", *sample)
 	}
 
-	// Compute regression coefficients
-	alpha, beta := stat.LinearRegression(y, xFlat, nil, false)
-	fmt.Printf("\nRegression Model (Normalized): Flaring Volume = %.4f + %.4f * Predictor\n", alpha, beta)
+	if !(*clipLow >= 0 && *clipLow < *clipHigh && *clipHigh <= 100) {
+		Logger.Fatalf("Error: need 0 <= -clip-low < -clip-high <= 100, got %g and %g", *clipLow, *clipHigh)
+	}
 
-	// Compute R-squared
-	yMean := stat.Mean(y, nil)
-	ssTotal, ssResidual := 0.0, 0.0
-	for i := range y {
-		predicted := alpha + beta*xFlat[i]
-		ssTotal += (y[i] - yMean) * (y[i] - yMean)
-		ssResidual += (y[i] - predicted) * (y[i] - predicted)
+	// Keep stdout for the results alone in the machine-readable formats
+	var report io.Writer = os.Stdout
+	switch *outputFormat {
+	case "text", "xlsx":
+	case "json", "csv":
+		report = os.Stderr
+	default:
+		Logger.Fatalf("Error: unknown output format %q (want \"text\", \"json\", \"csv\" or \"xlsx\")", *outputFormat)
 	}
-	rSquared := 1 - (ssResidual / ssTotal)
-	fmt.Printf("R-squared (Normalized): %.4f\n", rSquared)
-}
+	asExcel := *outputFormat == "xlsx"
 
-func main() {
-	// Load datasets
-	csvData := loadCSV("eog_global_flare_survey_2015_flare_list.csv")
-	excelData := loadExcel("2012-2023-individual-flare-volume-estimates.xlsx")
+	// Load datasets. The CSV side may be any delimited stream, whatever its name.
+	csvData, err := loadDelimitedWithOptions(*csvFile, CSVOptions{Delimiter: comma, Encoding: csvEncoding})
+	if err != nil {
+		Logger.Fatalf("Error loading CSV file: %v", err)
+	}
+	var excelData [][]string
+	switch {
+	case *sheet != "" && *sheetIndex != 0, *allSheets && (*sheet != "" || *sheetIndex != 0):
+		Logger.Fatalf("Error: -sheet, -sheet-index and -all-sheets are mutually exclusive")
+	case *allSheets:
+		excelData, err = loadExcelAllSheets(*excelFile)
+	case *sheet != "":
+		excelData, err = loadExcelSheet(*excelFile, *sheet)
+	case *sheetIndex != 0:
+		excelData, err = loadExcelByIndex(*excelFile, *sheetIndex)
+	default:
+		excelData, err = loadData(*excelFile)
+	}
+	if err != nil {
+		Logger.Fatalf("Error loading Excel file: %v", err)
+	}
+	if *trim {
+		trimCells(csvData)
+		trimCells(excelData)
+	}
+	csvData = withHeader(csvData, *csvHeader)
+	excelData = withHeader(excelData, *excelHeader)
+	if len(csvData) == 0 || len(csvData[0]) == 0 {
+		Logger.Fatalf("Error: CSV file %s is empty, with no header row", *csvFile)
+	}
+	if len(excelData) == 0 || len(excelData[0]) == 0 {
+		Logger.Fatalf("Error: Excel file %s is empty, with no header row", *excelFile)
+	}
+	summary := RunSummary{
+		CSVFile:   *csvFile,
+		ExcelFile: *excelFile,
+		CSVRows:   len(csvData) - 1,
+		ExcelRows: len(excelData) - 1,
+	}
+	if *limit > 0 && len(csvData)-1 > *limit {
+		csvData = csvData[:*limit+1]
+		fmt.Fprintf(report, "Limited CSV to the first %d rows\n", *limit)
+	}
 
 	// Extract headers
-	fmt.Println("CSV Headers:", csvData[0])
-	fmt.Println("Excel Headers:", excelData[0])
+	fmt.Fprintln(report, "CSV Headers:", csvData[0])
+	fmt.Fprintln(report, "Excel Headers:", excelData[0])
 
-	// Identify column indexes
-	csvCountryIndex, csvLatIndex, csvLonIndex := 0, 4, 5
-	excelCountryIndex, excelLatIndex, excelLonIndex, flaringVolIndex := 0, 1, 2, 10 // "Flaring Vol (million m3)"
+	if *schema {
+		printSchema("CSV", inferSchema(csvData))
+		printSchema("Excel", inferSchema(excelData))
+		return
+	}
+
+	// Flags set on the command line or in the config file
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	// Every randomized step takes its seed from -seed unless given its own,
+	// so the same seed always reproduces the same output
+	if *testSeed == 0 {
+		*testSeed = *seed
+	}
+	if *sampleSeed == 0 {
+		*sampleSeed = *seed
+	}
+
+	// Excel output gets Excel file names unless they were given
+	if asExcel {
+		if !explicit["joined"] {
+			*joinedFile = "joined_records.xlsx"
+		}
+		if !explicit["dangling"] {
+			*danglingFile = "dangling_records.xlsx"
+		}
+	}
+
+	// Identify column indexes from header names or raw indexes
+	// Without explicit coordinate columns, look for lat/lon header names
+	guess := func(label string, header []string, latSpec, lonSpec *string, prefix string) {
+		if explicit[prefix+"-lat"] || explicit[prefix+"-lon"] {
+			return
+		}
+		if lat, lon, ok := guessLatLon(header); ok {
+			*latSpec, *lonSpec = strconv.Itoa(lat), strconv.Itoa(lon)
+			Logger.Printf("Guessed %s coordinate columns: lat=[%d] %s, lon=[%d] %s", label, lat, header[lat], lon, header[lon])
+		}
+	}
+	guess("CSV", csvData[0], csvLatCol, csvLonCol, "csv")
+	guess("Excel", excelData[0], excelLatCol, excelLonCol, "excel")
 
+	resolve := func(header []string, spec, flagName string) int {
+		idx, err := resolveColumn(header, spec)
+		if err != nil {
+			Logger.Fatalf("Error resolving -%s: %v", flagName, err)
+		}
+		return idx
+	}
+	csvCountryIndex := resolve(csvData[0], *csvCountryCol, "csv-country")
+	csvLatIndex := resolve(csvData[0], *csvLatCol, "csv-lat")
+	csvLonIndex := resolve(csvData[0], *csvLonCol, "csv-lon")
+	excelCountryIndex := resolve(excelData[0], *excelCountryCol, "excel-country")
+	excelLatIndex := resolve(excelData[0], *excelLatCol, "excel-lat")
+	excelLonIndex := resolve(excelData[0], *excelLonCol, "excel-lon")
+	csvKeyIndex, excelKeyIndex := -1, -1
+	if *csvKeyCol != "" || *excelKeyCol != "" {
+		if *csvKeyCol == "" || *excelKeyCol == "" {
+			Logger.Fatalf("Error: -csv-key and -excel-key must be given together")
+		}
+		csvKeyIndex = resolve(csvData[0], *csvKeyCol, "csv-key")
+		excelKeyIndex = resolve(excelData[0], *excelKeyCol, "excel-key")
+	}
+	tieBreakMode, tieBreakIndex := TieByRowOrder, -1
+	if !strings.EqualFold(*tieBreak, "row") {
+		tieBreakMode, tieBreakIndex = TieByColumn, resolve(excelData[0], *tieBreak, "tie-break")
+	}
 	// Independent variables
 	independentIndexes := []int{6, 7, 8} // "flr_volume", "avg_temp", "dtc_freq"
 
-	// Filter Algeria records
-	algeriaCSV := filterAlgeria(csvData, csvCountryIndex)
-	algeriaExcel := filterAlgeria(excelData, excelCountryIndex)
+	if *listCountries {
+		printCounts("CSV countries", countByColumn(csvData[1:], csvCountryIndex))
+		printCounts("Excel countries", countByColumn(excelData[1:], excelCountryIndex))
+		return
+	}
+
+	// Catch swapped or mislabeled coordinate columns before joining
+	warnCoordinateRanges("CSV", csvData, csvLatIndex, csvLonIndex)
+	warnCoordinateRanges("Excel", excelData, excelLatIndex, excelLonIndex)
+
+	// Optionally drop duplicate CSV rows
+	if *dedupe {
+		var keyCols []int
+		if *dedupeOn != "" {
+			for _, spec := range strings.Split(*dedupeOn, ",") {
+				keyCols = append(keyCols, resolve(csvData[0], spec, "dedupe-on"))
+			}
+		}
+		before := len(csvData)
+		csvData = dedupeRowsOn(csvData, keyCols)
+		fmt.Fprintf(report, "Removed %d duplicate CSV rows\n", before-len(csvData))
+	}
+
+	// Filter country records, keeping each header as row 0
+	var countries []string
+	for _, c := range strings.Split(*country, ",") {
+		countries = append(countries, strings.TrimSpace(c))
+	}
+	pipeline, err := NewPipeline(csvData, excelData, csvCountryIndex, excelCountryIndex, JoinOptions{
+		CSVLatCol:     csvLatIndex,
+		CSVLonCol:     csvLonIndex,
+		ExcelLatCol:   excelLatIndex,
+		ExcelLonCol:   excelLonIndex,
+		RadiusKm:      *radiusKm,
+		Distance:      distance,
+		OneToOne:      *oneToOne,
+		Type:          joinType,
+		ProgressEvery: *progress,
+		CSVKeyCol:     csvKeyIndex,
+		ExcelKeyCol:   excelKeyIndex,
+		TieBreak:      tieBreakMode,
+		TieBreakCol:   tieBreakIndex,
+	})
+	if err != nil {
+		Logger.Fatalf("Error: %v", err)
+	}
+	pipeline.Filter(countries)
+	if *bbox != "" {
+		box, err := parseBoundingBox(*bbox)
+		if err != nil {
+			Logger.Fatalf("Error parsing -bbox: %v", err)
+		}
+		pipeline.CSV = append([][]string{pipeline.CSV[0]}, filterByBoundingBox(pipeline.CSV[1:], csvLatIndex, csvLonIndex, box[0], box[1], box[2], box[3])...)
+		pipeline.Excel = append([][]string{pipeline.Excel[0]}, filterByBoundingBox(pipeline.Excel[1:], excelLatIndex, excelLonIndex, box[0], box[1], box[2], box[3])...)
+	}
+	countryCSV, countryExcel := pipeline.CSV, pipeline.Excel
+	summary.CSVFiltered, summary.ExcelFiltered = len(countryCSV)-1, len(countryExcel)-1
 
 	// Print statistics
-	fmt.Printf("Filtered Algeria Records in CSV: %d\n", len(algeriaCSV)-1)
-	fmt.Printf("Filtered Algeria Records in Excel: %d\n", len(algeriaExcel)-1)
+	fmt.Fprintf(report, "Filtered %s Records in CSV: %d\n", *country, len(countryCSV)-1)
+	fmt.Fprintf(report, "Filtered %s Records in Excel: %d\n", *country, len(countryExcel)-1)
+
+	// Stop here in validate mode, before the expensive join
+	if *validate {
+		printValidation("CSV", countryCSV, csvCountryIndex, csvLatIndex, csvLonIndex)
+		printValidation("Excel", countryExcel, excelCountryIndex, excelLatIndex, excelLonIndex)
+		return
+	}
 
 	// Join datasets
-	joinedData, danglingData := joinDatasets(algeriaCSV, algeriaExcel, csvLatIndex, csvLonIndex, excelLatIndex, excelLonIndex)
-	
-	// Save dangling records
+	var joinResult JoinResult
+	if *candidates {
+		var counts []int
+		joinResult, counts, err = joinDatasetsWithCounts(pipeline.CSV, pipeline.Excel, pipeline.Options)
+		if err == nil {
+			pipeline.Result = joinResult
+			printCandidateHistogram(report, counts, 5)
+		}
+	} else {
+		joinResult, err = pipeline.Join()
+	}
+	if err != nil {
+		Logger.Fatalf("Error joining datasets: %v", err)
+	}
+	joinedData, danglingData := joinResult.Joined, joinResult.Dangling
+	summary.Joined, summary.Dangling = joinResult.Matched, len(danglingData)
+
+	// Report dangling records
+	fmt.Fprintf(report, "Dangling Records (no match within %.1fkm): %d of %d\n", *radiusKm, len(danglingData), joinResult.Matched+len(danglingData))
 	if len(danglingData) > 0 {
-		fmt.Println("Dangling records detected! Here are the first 5:")
+		fmt.Fprintln(report, "Dangling records detected! Here are the first 5:")
 		for i := 0; i < len(danglingData) && i < 5; i++ {
-			fmt.Println(danglingData[i]) // Print first 5 records
+			fmt.Fprintln(report, danglingData[i]) // Print first 5 records
+		}
+	} else {
+		fmt.Fprintln(report, " No dangling records found.")
+	}
+	if *explain > 0 {
+		explainDangling(report, pipeline.CSV[0], danglingData, pipeline.Excel, pipeline.Options, *explain)
+	}
+
+	// Warn loudly when most rows failed to join: usually a wrong column or radius
+	if total := joinResult.Matched + len(danglingData); total > 0 {
+		ratio := float64(len(danglingData)) / float64(total)
+		if ratio > *danglingWarn {
+			Logger.Printf("WARNING: %.1f%% of CSV rows (%d of %d) did not join (threshold %.1f%%). Check the lat/lon columns and -radius.\n",
+				100*ratio, len(danglingData), total, 100*(*danglingWarn))
+		}
+	}
+
+	// Save dangling records, even when empty, so a stale file is never left behind
+	if err := SaveDanglingRecords(*danglingFile, csvData[0], danglingData, asExcel); err != nil {
+		Logger.Fatalf("Error saving dangling records: %v", err)
+	}
+	fmt.Fprintf(report, "Saved dangling records to '%s'\n", *danglingFile)
+
+	// Print merge results
+	fmt.Fprintf(report, "Joined Records (within %.1fkm): %d\n", *radiusKm, joinResult.Matched)
+	if len(joinedData) > joinResult.Matched {
+		fmt.Fprintf(report, "Unmatched rows kept by the %s join: %d\n", *joinName, len(joinedData)-joinResult.Matched)
+	}
+	if dupes := joinResult.DuplicateMatches(); dupes > 0 {
+		Logger.Printf("Warning: %d Excel rows were matched to more than one CSV row (use -one-to-one to prevent this)\n", dupes)
+	}
+
+	// Save joined records with the combined header
+	joinedHeader := joinResult.Header
+	if err := writeRows(*joinedFile, "Joined", append([][]string{joinedHeader}, joinedData...), asExcel); err != nil {
+		Logger.Fatalf("Error saving joined records: %v", err)
+	}
+	fmt.Fprintf(report, "Saved joined records to '%s'\n", *joinedFile)
+
+	// Pick the target and predictors from the command line, checked against
+	// the joined header
+	targetIndex := resolve(joinedHeader, *target, "target")
+	if *predictors != "" {
+		independentIndexes = nil
+		for _, spec := range strings.Split(*predictors, ",") {
+			if strings.TrimSpace(spec) == "" {
+				Logger.Fatalf("Error resolving -predictors: empty column in %q", *predictors)
+			}
+			independentIndexes = append(independentIndexes, resolve(joinedHeader, spec, "predictors"))
 		}
+	}
 
-		fmt.Println("Saving dangling records to 'dangling_records.csv'...")
-		SaveDanglingRecords("dangling_records.csv", danglingData)
+	// Extract regression data from the matched rows only
+	matchedData := joinResult.MatchedRows()
+	if *sample > 0 {
+		matchedData = sampleRows(append([][]string{joinedHeader}, matchedData...), *sample, *sampleSeed)[1:]
+		fmt.Fprintf(report, "Sampled %d of %d joined records for regression\n", len(matchedData), joinResult.Matched)
+	}
+	// Drop rows with blank cells up front so the per-row steps below stay aligned
+	if *blankMissing {
+		before := len(matchedData)
+		matchedData = dropBlankRows(matchedData, targetIndex, independentIndexes, *impute)
+		fmt.Fprintf(report, "Dropped %d of %d joined records with blank cells\n", before-len(matchedData), before)
+	}
+	y, x := extractRegressionData(matchedData, targetIndex, independentIndexes, *impute, *blankMissing)
 
-		// Verify file creation
-		if _, err := os.Stat("dangling_records.csv"); err == nil {
-			fmt.Println(" File 'dangling_records.csv' successfully created!")
+	var predictorNames []string
+	for _, idx := range independentIndexes {
+		if idx < len(joinedHeader) {
+			predictorNames = append(predictorNames, joinedHeader[idx])
 		} else {
-			fmt.Printf(" Error: File not created: %v\n", err)
+			predictorNames = append(predictorNames, fmt.Sprintf("column %d", idx))
 		}
-	} else {
-		fmt.Println(" No dangling records found.")
 	}
 
-	// Print merge results
-	fmt.Printf("Joined Records (within 3km): %d\n", len(joinedData))
+	// Optionally replace the predictors with powers of the first one
+	if *polyDegree > 1 {
+		base := make([]float64, len(x))
+		for i, row := range x {
+			if len(row) == 0 {
+				Logger.Fatalf("Error: row %d has no value for %s to expand", i, predictorNames[0])
+			}
+			base[i] = row[0]
+		}
+		x = polynomialFeatures(base, *polyDegree)
+		name := predictorNames[0]
+		predictorNames = []string{name}
+		for d := 2; d <= *polyDegree; d++ {
+			predictorNames = append(predictorNames, fmt.Sprintf("%s^%d", name, d))
+		}
+	}
 
-	// Extract regression data
-	y, x := extractRegressionData(joinedData, flaringVolIndex, independentIndexes)
+	// Optionally add dummy columns for a categorical predictor, aligned with
+	// the rows extractRegressionData kept
+	if *categorical != "" {
+		catCol := resolve(joinedHeader, *categorical, "categorical")
+		var rows [][]string
+		for _, row := range matchedData {
+			if len(row) > targetIndex {
+				rows = append(rows, row)
+			}
+		}
+		dummies, levels := oneHotEncode(rows, catCol)
+		for i := range x {
+			x[i] = append(x[i], dummies[i]...)
+		}
+		for _, level := range levels {
+			predictorNames = append(predictorNames, joinedHeader[catCol]+"="+level)
+		}
+	}
+
+	// Optionally weight rows by how close their match was
+	var weights []float64
+	if *weightHalfKm > 0 {
+		distCol, err := colIndex(joinedHeader, distanceColumn)
+		if err != nil {
+			Logger.Fatalf("Error weighting by distance: %v", err)
+		}
+		var distances []float64
+		for _, row := range matchedData {
+			if len(row) > targetIndex {
+				distances = append(distances, parseFloat(row[distCol]))
+			}
+		}
+		weights = distanceWeights(distances, *weightHalfKm)
+	}
+
+	// Optionally drop rows with extreme target values
+	if *clipLow > 0 || *clipHigh < 100 {
+		var kept []int
+		before := len(y)
+		y, x, kept = clipOutliers(y, x, *clipLow, *clipHigh)
+		if weights != nil {
+			clipped := make([]float64, len(kept))
+			for i, idx := range kept {
+				clipped[i] = weights[idx]
+			}
+			weights = clipped
+		}
+		fmt.Fprintf(report, "Dropped %d of %d rows outside the %g-%g percentiles of the target\n", before-len(y), before, *clipLow, *clipHigh)
+	}
+
+	// Optionally map the target onto a normal distribution by rank
+	var targetTransform *QuantileTransform
+	var targetMin, targetMax float64
+	if *quantileTarget {
+		targetMin, targetMax = minMax(y)
+		targetTransform, y = newQuantileTransform(y)
+	}
 
 	// Run regression analysis
-	runRegression(y, x)
+	var result RegressionResult
+	switch {
+	case *robust && *testFrac > 0:
+		err = fmt.Errorf("-robust cannot be combined with -test-frac")
+	case *robust && *cvFolds > 0:
+		err = fmt.Errorf("-robust cannot be combined with -cv-folds")
+	case *robust:
+		result, err = runHuberRegression(y, x, weights, *scaling)
+	case *testFrac > 0:
+		result, err = runRegressionHoldout(y, x, weights, *scaling, *testFrac, *testSeed)
+	default:
+		result, err = runRegression(y, x, weights, *scaling)
+	}
+	if err != nil {
+		Logger.Fatalf("Error running regression: %v", err)
+	}
+	if *cvFolds > 0 {
+		scores, err := crossValidate(y, x, weights, *scaling, *cvFolds, *testSeed)
+		if err != nil {
+			Logger.Fatalf("Error cross-validating: %v", err)
+		}
+		result.CVFolds = *cvFolds
+		result.CVRSquaredMean, result.CVRSquaredStdDev = stat.MeanStdDev(scores, nil)
+	}
+	result.Predictors = predictorNames
+	if targetTransform != nil {
+		result.TargetTransform = targetTransform
+		// Report the target range and errors in the original units, not
+		// the normal scores the fit saw
+		result.TargetMin, result.TargetMax = targetMin, targetMax
+		result.setErrors()
+	}
+	switch *outputFormat {
+	case "json":
+		err = result.WriteJSON(os.Stdout)
+	case "csv":
+		err = result.WriteCSVSummary(os.Stdout)
+	default:
+		printRegressionResult(result)
+		printCorrelationMatrix(correlationMatrix(x), result)
+		printVIF(vif(x), result)
+	}
+	if err != nil {
+		Logger.Fatalf("Error writing results: %v", err)
+	}
+
+	// Export the model as JSON
+	if *jsonFile != "" {
+		file, err := os.Create(*jsonFile)
+		if err != nil {
+			Logger.Fatalf("Error creating JSON file: %v", err)
+		}
+		defer file.Close()
+		if err := result.WriteJSON(file); err != nil {
+			Logger.Fatalf("Error writing JSON file: %v", err)
+		}
+		fmt.Fprintf(report, "Saved regression results to '%s'\n", *jsonFile)
+	}
+
+	// Summarize the whole run in one file
+	if *reportFile != "" {
+		summary.Regression = &result
+		if err := writeReport(*reportFile, summary); err != nil {
+			Logger.Fatalf("Error saving report: %v", err)
+		}
+		fmt.Fprintf(report, "Saved report to '%s'\n", *reportFile)
+	}
 }
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestNormalizeConstantColumn(t *testing.T) {
+	got := normalize([]float64{5, 5, 5})
+	if len(got) != 3 {
+		t.Fatalf("normalize returned %d values, want 3", len(got))
+	}
+	for i, v := range got {
+		if math.IsNaN(v) {
+			t.Errorf("normalize()[%d] is NaN, want 0", i)
+		} else if v != 0 {
+			t.Errorf("normalize()[%d] = %g, want 0", i, v)
+		}
+	}
+}
+
+// Join by checking every Excel row for every CSV row, keeping the first
+// closest one, as joinDatasets did before the spatial grid
+func linearScanJoin(csvData, excelData [][]string, opts JoinOptions) (joined, dangling [][]string) {
+	excelRows := excelData[1:]
+	lats, lons := make([]float64, len(excelRows)), make([]float64, len(excelRows))
+	valid := make([]bool, len(excelRows))
+	for i, excelRow := range excelRows {
+		lats[i], lons[i], valid[i] = parseLatLon(excelRow, opts.ExcelLatCol, opts.ExcelLonCol)
+	}
+
+	for _, csvRow := range csvData[1:] {
+		csvLat, csvLon, ok := parseLatLon(csvRow, opts.CSVLatCol, opts.CSVLonCol)
+		if !ok {
+			continue
+		}
+		closest := opts.RadiusKm
+		if opts.RadiusKm <= 0 {
+			closest = math.Inf(1)
+		}
+		var best []string
+		for i, excelRow := range excelRows {
+			if !valid[i] {
+				continue
+			}
+			if d := haversine(csvLat, csvLon, lats[i], lons[i]); d < closest {
+				closest, best = d, excelRow
+			}
+		}
+		if best == nil {
+			dangling = append(dangling, csvRow)
+			continue
+		}
+		row := append(append(append([]string{}, csvRow...), best...), strconv.FormatFloat(closest, 'f', 3, 64))
+		joined = append(joined, row)
+	}
+	return joined, dangling
+}
+
+// Random lat/lon rows, mostly in one dense cluster but also near a pole,
+// across the antimeridian, out of range and unparseable
+func syntheticCoordinates(r *rand.Rand, n int) [][]string {
+	rows := [][]string{{"lat", "lon"}}
+	for i := 0; i < n; i++ {
+		var lat, lon float64
+		switch r.Intn(10) {
+		case 0:
+			lat, lon = 89.9+r.Float64()*0.1, r.Float64()*360-180
+		case 1:
+			lat, lon = r.Float64()*10-5, 179.95+r.Float64()*0.1
+		case 2:
+			lat, lon = r.Float64()*200-100, r.Float64()*800-400
+		default:
+			lat, lon = 30+r.Float64()*2, r.Float64()*2
+		}
+		latCell := strconv.FormatFloat(lat, 'f', -1, 64)
+		if r.Intn(50) == 0 {
+			latCell = "N/A"
+		}
+		rows = append(rows, []string{latCell, strconv.FormatFloat(lon, 'f', -1, 64)})
+	}
+	return rows
+}
+
+func TestJoinMatchesLinearScan(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, radius := range []float64{0, 0.5, 3, 50, 2000, 30000} {
+		csvData := syntheticCoordinates(r, 1000)
+		excelData := syntheticCoordinates(r, 1000)
+		// Exact duplicates make equidistant candidates, whose tie-break must match too
+		excelData = append(excelData, csvData[1:50]...)
+		excelData = append(excelData, csvData[1:50]...)
+
+		opts := JoinOptions{CSVLatCol: 0, CSVLonCol: 1, ExcelLatCol: 0, ExcelLonCol: 1, RadiusKm: radius, CSVKeyCol: -1, ExcelKeyCol: -1}
+		got, err := joinDatasets(csvData, excelData, opts)
+		if err != nil {
+			t.Fatalf("radius %g: %v", radius, err)
+		}
+		wantJoined, wantDangling := linearScanJoin(csvData, excelData, opts)
+		if !reflect.DeepEqual(got.Joined, wantJoined) {
+			t.Errorf("radius %g: joined %d rows differ from the linear scan's %d", radius, len(got.Joined), len(wantJoined))
+		}
+		if !reflect.DeepEqual(got.Dangling, wantDangling) {
+			t.Errorf("radius %g: dangling %d rows differ from the linear scan's %d", radius, len(got.Dangling), len(wantDangling))
+		}
+	}
+}
+
+// Rows per dataset in BenchmarkJoin
+const benchJoinRows = 50000
+
+func BenchmarkJoin(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	csvData := syntheticCoordinates(r, benchJoinRows)
+	excelData := syntheticCoordinates(r, benchJoinRows)
+	opts := JoinOptions{CSVLatCol: 0, CSVLonCol: 1, ExcelLatCol: 0, ExcelLonCol: 1, RadiusKm: 3, CSVKeyCol: -1, ExcelKeyCol: -1}
+
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			linearScanJoin(csvData, excelData, opts)
+		}
+	})
+	b.Run("grid", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := joinDatasets(csvData, excelData, opts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// Pairs of nearby points for the haversine benchmarks
+func benchmarkPoints() (lats, lons, cosLats []float64) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1024; i++ {
+		lat := 30 + r.Float64()*2
+		lats = append(lats, lat)
+		lons = append(lons, r.Float64()*2)
+		cosLats = append(cosLats, math.Cos(lat*(math.Pi/180.0)))
+	}
+	return lats, lons, cosLats
+}
+
+// Sink that keeps the compiler from eliminating benchmarked distance calls
+var benchDistance float64
+
+func BenchmarkHaversine(b *testing.B) {
+	lats, lons, _ := benchmarkPoints()
+	n := len(lats)
+	for i := 0; i < b.N; i++ {
+		j, k := i%n, (i+1)%n
+		benchDistance = haversine(lats[j], lons[j], lats[k], lons[k])
+	}
+}
+
+func BenchmarkHaversineCos(b *testing.B) {
+	lats, lons, cosLats := benchmarkPoints()
+	n := len(lats)
+	for i := 0; i < b.N; i++ {
+		j, k := i%n, (i+1)%n
+		benchDistance = haversineCos(lats[j], lons[j], cosLats[j], lats[k], lons[k], cosLats[k])
+	}
+}
+
+func TestLoadCSVStripsBOM(t *testing.T) {
+	data, err := loadCSV("testdata/bom.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 3 {
+		t.Fatalf("loadCSV returned %d rows, want 3", len(data))
+	}
+	if data[0][0] != "Country" {
+		t.Errorf("first header cell = %q, want %q", data[0][0], "Country")
+	}
+}
+
+func TestStreamCSVSkipsMalformedRows(t *testing.T) {
+	var logged bytes.Buffer
+	Logger.SetOutput(&logged)
+	defer Logger.SetOutput(os.Stderr)
+
+	// Rows before the unclosed quote on line 9 still stream; that quote
+	// swallows the rest of the file, so the read fails instead of losing it
+	var data [][]string
+	err := streamCSV("testdata/malformed.csv", func(row []string) error {
+		data = append(data, row)
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "line 9") {
+		t.Errorf("streamCSV returned error %v, want the unclosed quote on line 9", err)
+	}
+	want := [][]string{
+		{"name", "lat", "lon"},
+		{"Lisbon\nPortugal", "38.72", "-9.14"},
+		{"Madrid", "40.42"},
+		{"Rome", "41.90", "12.50"},
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("streamCSV returned %q, want %q", data, want)
+	}
+	if !strings.Contains(logged.String(), "Skipped 3 malformed rows in testdata/malformed.csv (lines 5, 6-7, 9-10)") {
+		t.Errorf("logged %q, want the skipped lines", logged.String())
+	}
+	if _, err := loadCSV("testdata/malformed.csv"); err == nil {
+		t.Error("loadCSV succeeded on a file ending in an unclosed quote")
+	}
+}
+
+func TestLoadExcelRawValuesAndFormulas(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "coords.xlsx")
+	f := excelize.NewFile()
+	sheet := f.GetSheetName(0)
+	for cell, value := range map[string]interface{}{"A1": "lat", "B1": "lon", "C1": "double", "A2": 36.75, "B2": -9.5} {
+		if err := f.SetCellValue(sheet, cell, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A coordinate displayed as a date, and a formula saved without a cached result
+	dateStyle, err := f.NewStyle(&excelize.Style{NumFmt: 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetCellStyle(sheet, "A2", "A2", dateStyle); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetCellFormula(sheet, "C2", "A2*2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveAs(filename); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	data, err := loadExcel(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"lat", "lon", "double"}, {"36.75", "-9.5", "73.5"}}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("loadExcel returned %q, want %q", data, want)
+	}
+}
+
+func TestJoinSkipsTruncatedRows(t *testing.T) {
+	var logged bytes.Buffer
+	Logger.SetOutput(&logged)
+	defer Logger.SetOutput(os.Stderr)
+
+	csvData := [][]string{
+		{"name", "lat", "lon"},
+		{"Lisbon", "38.72", "-9.14"},
+		{"Truncated", "40.42"},
+		{"Rome", "41.90", "12.50"},
+	}
+	excelData := [][]string{
+		{"lat", "lon", "population"},
+		{"38.72", "-9.14", "545000"},
+		{"41.89"},
+	}
+	opts := JoinOptions{CSVLatCol: 1, CSVLonCol: 2, ExcelLatCol: 0, ExcelLonCol: 1, RadiusKm: 5, CSVKeyCol: -1, ExcelKeyCol: -1}
+	result, err := joinDatasets(csvData, excelData, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Matched != 1 || len(result.Joined) != 1 || result.Joined[0][0] != "Lisbon" {
+		t.Errorf("joined %q, want only Lisbon", result.Joined)
+	}
+	want := [][]string{{"Rome", "41.90", "12.50"}}
+	if !reflect.DeepEqual(result.Dangling, want) {
+		t.Errorf("dangling %q, want %q", result.Dangling, want)
+	}
+	if !strings.Contains(logged.String(), "Skipped rows too short to hold the coordinate columns: 1 in CSV, 1 in Excel") {
+		t.Errorf("logged %q, want the short row counts", logged.String())
+	}
+}
+
+// Noisy rows of y = 3 + 2·x1 - 0.5·x2, with x1 in [0, 100) and x2 in [-50, 50)
+func syntheticLinear(r *rand.Rand, n int) (y []float64, x [][]float64) {
+	for i := 0; i < n; i++ {
+		x1, x2 := r.Float64()*100, r.Float64()*100-50
+		x = append(x, []float64{x1, x2})
+		y = append(y, 3+2*x1-0.5*x2+r.NormFloat64()*0.1)
+	}
+	return y, x
+}
+
+func TestPredictionIntervalOriginalUnits(t *testing.T) {
+	y, x := syntheticLinear(rand.New(rand.NewSource(1)), 200)
+	result, err := runRegression(y, x, nil, scalingMinMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row := []float64{50, 10}
+	predicted, lower, upper, err := result.PredictionInterval(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := result.Predict([][]float64{row})[0]; math.Abs(predicted-want) > 1e-9 {
+		t.Errorf("PredictionInterval predicted %g, Predict %g", predicted, want)
+	}
+	if math.Abs(predicted-98) > 0.1 {
+		t.Errorf("predicted %g, want about 98", predicted)
+	}
+	if !(lower < predicted && predicted < upper) || upper-lower > 1 {
+		t.Errorf("interval [%g, %g] around %g, want a narrow one containing it", lower, upper, predicted)
+	}
+}
+
+func TestPredictNewRows(t *testing.T) {
+	trainY, trainX := syntheticLinear(rand.New(rand.NewSource(1)), 200)
+	testY, testX := syntheticLinear(rand.New(rand.NewSource(2)), 50)
+	for _, scaling := range []string{scalingMinMax, scalingZScore, scalingRobust} {
+		result, err := runRegression(trainY, trainX, nil, scaling)
+		if err != nil {
+			t.Fatalf("%s: %v", scaling, err)
+		}
+		for i, got := range result.Predict(testX) {
+			if math.Abs(got-testY[i]) > 1 {
+				t.Errorf("%s: row %d predicted %g, want about %g", scaling, i, got, testY[i])
+			}
+		}
+		if got := result.Predict([][]float64{{1}}); !math.IsNaN(got[0]) {
+			t.Errorf("%s: predicted %g for a row of the wrong width, want NaN", scaling, got[0])
+		}
+	}
+}
+
+func TestLoadDelimitedUnknownExtension(t *testing.T) {
+	csv, err := os.ReadFile("testdata/bom.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "flares.dat")
+	if err := os.WriteFile(filename, csv, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDataWithOptions(filename, CSVOptions{}); err == nil {
+		t.Error("loadDataWithOptions accepted a .dat file")
+	}
+	data, err := loadDelimitedWithOptions(filename, CSVOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 3 || data[0][0] != "Country" {
+		t.Errorf("loadDelimitedWithOptions returned %q, want the 3 rows of bom.csv", data)
+	}
+}
+
+func TestOuterJoinsKeepSkippedCSVRows(t *testing.T) {
+	Logger.SetOutput(&bytes.Buffer{})
+	defer Logger.SetOutput(os.Stderr)
+
+	csvData := [][]string{
+		{"name", "lat", "lon"},
+		{"Lisbon", "38.72", "-9.14"},
+		{"Unparseable", "N/A", "-3.70"},
+		{"Truncated", "40.42"},
+		{"Rome", "41.90", "12.50"},
+	}
+	excelData := [][]string{
+		{"lat", "lon", "population"},
+		{"38.72", "-9.14", "545000"},
+		{"10", "10", "1"},
+	}
+	for _, joinType := range []JoinType{LeftJoin, FullJoin, AuditJoin} {
+		opts := JoinOptions{CSVLatCol: 1, CSVLonCol: 2, ExcelLatCol: 0, ExcelLonCol: 1, RadiusKm: 5, CSVKeyCol: -1, ExcelKeyCol: -1, Type: joinType}
+		result, err := joinDatasets(csvData, excelData, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := map[string]bool{}
+		for _, row := range result.Joined {
+			names[row[0]] = true
+			if len(row) != len(result.Header) {
+				t.Errorf("join type %d: row %q has %d cells, want %d", joinType, row, len(row), len(result.Header))
+			}
+		}
+		for _, row := range csvData[1:] {
+			if !names[row[0]] {
+				t.Errorf("join type %d dropped CSV row %q", joinType, row)
+			}
+		}
+		if want := [][]string{{"Rome", "41.90", "12.50"}}; !reflect.DeepEqual(result.Dangling, want) {
+			t.Errorf("join type %d: dangling %q, want %q", joinType, result.Dangling, want)
+		}
+	}
+}
+
+func TestCrossValidateRejectsSingleRowFolds(t *testing.T) {
+	y, x := syntheticLinear(rand.New(rand.NewSource(1)), 60)
+	for _, folds := range []int{31, 40, 60} {
+		if _, err := crossValidate(y, x, nil, scalingMinMax, folds, 1); err == nil {
+			t.Errorf("%d folds of 60 rows accepted", folds)
+		}
+	}
+	scores, err := crossValidate(y, x, nil, scalingMinMax, 30, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for f, r2 := range scores {
+		if math.IsInf(r2, 0) || math.IsNaN(r2) {
+			t.Errorf("fold %d scored R-squared %g", f+1, r2)
+		}
+	}
+}
+
+func TestHoldoutRejectsSingleTestRow(t *testing.T) {
+	y, x := syntheticLinear(rand.New(rand.NewSource(1)), 60)
+	if _, err := runRegressionHoldout(y, x, nil, scalingMinMax, 0.01, 1); err == nil {
+		t.Error("a test split of 1 row was accepted")
+	}
+	result, err := runRegressionHoldout(y, x, nil, scalingMinMax, 0.05, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TestN < 2 || math.IsInf(result.TestRSquared, 0) || math.IsNaN(result.TestRSquared) {
+		t.Errorf("test R-squared %g on %d rows", result.TestRSquared, result.TestN)
+	}
+}